@@ -0,0 +1,373 @@
+// Command bench measures preprocessing and query performance of the graph
+// package on a DIMACS road network.
+//
+// usage: bench [flags] <experiment> <node file> <arc file>
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/adrs/shortestpath/graph"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+type query struct {
+	src, dest int
+}
+
+type options struct {
+	landmarks int
+	workers   int
+	delta     int
+	cells     int
+	levels    int
+	fanout    int
+}
+
+type experiment func(g *graph.Graph, queries []query, opts options)
+
+var experiments = map[string]experiment{
+	"crp":            customizableRoutes,
+	"delta-stepping": deltaStepping,
+	"hub-labels":     hubLabels,
+	"landmarks":      landmarkFormats,
+	"reorder":        vertexOrders,
+	"transit-nodes":  transitNodes,
+}
+
+// Result of running a batch of queries with one search method
+type queryStats struct {
+	total   time.Duration
+	visited int
+	// Lengths of the paths found, -1 for no path
+	lengths []int
+}
+
+func runQueries(g *graph.Graph, queries []query, potential func(dest int) graph.PotentialFunc) queryStats {
+	stats := queryStats{lengths: make([]int, len(queries))}
+	for i, q := range queries {
+		start := time.Now()
+		path, seq := graph.SearchSequence(g, q.src, q.dest, potential(q.dest))
+		stats.total += time.Since(start)
+		stats.visited += len(seq)
+		stats.lengths[i] = graph.PathLength(g, graph.Reversed(path))
+	}
+	return stats
+}
+
+func (s queryStats) report(name string, queries int) {
+	fmt.Printf("%-16s %12.1f us/query %10.0f visited/query\n", name,
+		float64(s.total.Microseconds())/float64(queries), float64(s.visited)/float64(queries))
+}
+
+// Reports how many queries found a different length than the reference
+func checkLengths(name string, got, want []int) {
+	wrong := 0
+	for i := range got {
+		if got[i] != want[i] {
+			wrong++
+		}
+	}
+	if wrong > 0 {
+		fmt.Printf("%-16s %d queries disagree with Dijkstra\n", name, wrong)
+	}
+}
+
+// Compares memory and query time of the landmark distance formats
+func landmarkFormats(g *graph.Graph, queries []query, opts options) {
+	landmarks := graph.ParallelPickFarthestLandmarks(g, opts.landmarks, opts.workers, nil)
+	dijkstra := runQueries(g, queries, func(int) graph.PotentialFunc {
+		return func(int) int { return 0 }
+	})
+	dijkstra.report("dijkstra", len(queries))
+
+	start := time.Now()
+	legacy := graph.ParallelDistancesFromLandmarks(g, landmarks, opts.workers, nil)
+	fmt.Printf("%-16s %12d bytes %10.1f s preprocessing\n", "[][]int",
+		8*len(g.Nodes)*len(landmarks), time.Since(start).Seconds())
+	stats := runQueries(g, queries, func(dest int) graph.PotentialFunc {
+		return graph.LandmarkPotential(legacy, dest)
+	})
+	stats.report("[][]int", len(queries))
+	checkLengths("[][]int", stats.lengths, dijkstra.lengths)
+
+	for _, format := range []graph.LandmarkFormat{graph.LandmarkUint32, graph.LandmarkUint16} {
+		start := time.Now()
+		ld, err := graph.NewLandmarkDistances(g, landmarks, format, opts.workers, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%-16s %12d bytes %10.1f s preprocessing\n", format, ld.Bytes(), time.Since(start).Seconds())
+		stats := runQueries(g, queries, ld.Potential)
+		stats.report(format.String(), len(queries))
+		checkLengths(format.String(), stats.lengths, dijkstra.lengths)
+	}
+}
+
+// Compares query time of Dijkstra and ALT after renumbering vertices
+func vertexOrders(g *graph.Graph, queries []query, opts options) {
+	landmarks := graph.ParallelPickFarthestLandmarks(g, opts.landmarks, opts.workers, nil)
+	for _, name := range []string{"none", "bfs", "hilbert"} {
+		p := g
+		start := time.Now()
+		if name != "none" {
+			var err error
+			if p, err = g.Permute(graph.VertexOrders[name](g)); err != nil {
+				log.Fatal(err)
+			}
+		}
+		fmt.Printf("%-16s %10.1f s reordering\n", name, time.Since(start).Seconds())
+		// Same queries and landmarks under the new numbering
+		renumbered := make([]query, len(queries))
+		for i, q := range queries {
+			renumbered[i] = query{p.Vertex(g.OriginalID(q.src)), p.Vertex(g.OriginalID(q.dest))}
+		}
+		pLandmarks := make([]int, len(landmarks))
+		for i, l := range landmarks {
+			pLandmarks[i] = p.Vertex(g.OriginalID(l))
+		}
+		ld, err := graph.NewLandmarkDistances(p, pLandmarks, graph.LandmarkUint32, opts.workers, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dijkstra := runQueries(p, renumbered, func(int) graph.PotentialFunc {
+			return func(int) int { return 0 }
+		})
+		dijkstra.report(name+" dijkstra", len(queries))
+		alt := runQueries(p, renumbered, ld.Potential)
+		alt.report(name+" alt", len(queries))
+		checkLengths(name+" alt", alt.lengths, dijkstra.lengths)
+	}
+}
+
+// Most sources to compute full distance maps from, since each takes a
+// whole graph search
+const maxOneToAllSources = 20
+
+// Compares one-to-all distance computation of Dijkstra and delta-stepping
+// with a range of bucket widths
+func deltaStepping(g *graph.Graph, queries []query, opts options) {
+	sources := make([]int, 0, maxOneToAllSources)
+	for i := 0; i < len(queries) && i < maxOneToAllSources; i++ {
+		sources = append(sources, queries[i].src)
+	}
+	want := make([][]int, len(sources))
+	start := time.Now()
+	for i, src := range sources {
+		want[i] = graph.Dijkstra(g, src)
+	}
+	fmt.Printf("%-16s %12.1f ms/source\n", "dijkstra", float64(time.Since(start).Milliseconds())/float64(len(sources)))
+
+	deltas := []int{opts.delta}
+	if opts.delta <= 0 {
+		d := graph.DefaultDelta(g)
+		deltas = []int{d / 4, d, 4 * d, 16 * d}
+	}
+	for _, delta := range deltas {
+		name := fmt.Sprintf("delta %d", delta)
+		got := make([][]int, len(sources))
+		start := time.Now()
+		for i, src := range sources {
+			got[i] = graph.DeltaStepping(g, src, delta, opts.workers)
+		}
+		fmt.Printf("%-16s %12.1f ms/source\n", name, float64(time.Since(start).Milliseconds())/float64(len(sources)))
+		wrong := 0
+		for i := range sources {
+			for v := range got[i] {
+				if got[i][v] != want[i][v] {
+					wrong++
+					break
+				}
+			}
+		}
+		if wrong > 0 {
+			fmt.Printf("%-16s %d sources disagree with Dijkstra\n", name, wrong)
+		}
+	}
+}
+
+// Compares hub label distance and path queries with ALT
+func hubLabels(g *graph.Graph, queries []query, opts options) {
+	landmarks := graph.ParallelPickFarthestLandmarks(g, opts.landmarks, opts.workers, nil)
+	ld, err := graph.NewLandmarkDistances(g, landmarks, graph.LandmarkUint32, opts.workers, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	alt := runQueries(g, queries, ld.Potential)
+	alt.report("alt", len(queries))
+
+	start := time.Now()
+	hl, err := graph.NewHubLabels(g, graph.HubOrder(g, hubOrderSamples, opts.workers), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%-16s %12d bytes %10.1f s preprocessing %6.1f hubs/label\n", "hub labels",
+		hl.Bytes(), time.Since(start).Seconds(), hl.AverageLabelSize())
+
+	start = time.Now()
+	for _, q := range queries {
+		hl.Distance(q.src, q.dest)
+	}
+	fmt.Printf("%-16s %12.3f us/query\n", "hl distance", float64(time.Since(start).Nanoseconds())/1e3/float64(len(queries)))
+
+	lengths := make([]int, len(queries))
+	start = time.Now()
+	for i, q := range queries {
+		lengths[i] = graph.PathLength(g, hl.Path(q.src, q.dest))
+	}
+	fmt.Printf("%-16s %12.3f us/query\n", "hl path", float64(time.Since(start).Nanoseconds())/1e3/float64(len(queries)))
+	checkLengths("hub labels", lengths, alt.lengths)
+}
+
+// Shortest path trees sampled to order hubs by importance
+const hubOrderSamples = 32
+
+// Compares transit node routing, split into local and long distance
+// queries, with ALT
+func transitNodes(g *graph.Graph, queries []query, opts options) {
+	landmarks := graph.ParallelPickFarthestLandmarks(g, opts.landmarks, opts.workers, nil)
+	ld, err := graph.NewLandmarkDistances(g, landmarks, graph.LandmarkUint32, opts.workers, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	alt := runQueries(g, queries, ld.Potential)
+	alt.report("alt", len(queries))
+
+	start := time.Now()
+	tn, err := graph.NewTransitNodes(g, graph.CoordinatePartition(g, opts.cells), opts.workers, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%-16s %12d bytes %10.1f s preprocessing %6d transit nodes %6.1f access nodes\n", "transit nodes",
+		tn.Bytes(), time.Since(start).Seconds(), tn.Len(), tn.AverageAccessNodes())
+
+	var local, long queryStats
+	numLocal := 0
+	lengths := make([]int, len(queries))
+	for i, q := range queries {
+		stats := &long
+		if tn.IsLocal(q.src, q.dest) {
+			stats = &local
+			numLocal++
+		}
+		start := time.Now()
+		path, seq := tn.SearchSequence(q.src, q.dest, ld.Potential)
+		stats.total += time.Since(start)
+		stats.visited += len(seq)
+		lengths[i] = graph.PathLength(g, graph.Reversed(path))
+	}
+	if numLocal > 0 {
+		local.report("tnr local", numLocal)
+	}
+	if numLocal < len(queries) {
+		long.report("tnr long", len(queries)-numLocal)
+	}
+	checkLengths("transit nodes", lengths, alt.lengths)
+}
+
+// Compares customizable route planning with ALT, then customizes a metric
+// where every fifth arc is twice as slow and compares it with Dijkstra
+func customizableRoutes(g *graph.Graph, queries []query, opts options) {
+	landmarks := graph.ParallelPickFarthestLandmarks(g, opts.landmarks, opts.workers, nil)
+	ld, err := graph.NewLandmarkDistances(g, landmarks, graph.LandmarkUint32, opts.workers, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	alt := runQueries(g, queries, ld.Potential)
+	alt.report("alt", len(queries))
+
+	start := time.Now()
+	overlay := graph.NewOverlay(g, graph.CoordinateMultilevelPartition(g, opts.levels, opts.fanout))
+	fmt.Printf("%-16s %12d clique arcs %10.3f s preprocessing\n", "overlay", overlay.CliqueArcs(), time.Since(start).Seconds())
+
+	slow := make([]uint32, len(g.Weights))
+	for i, w := range g.Weights {
+		slow[i] = w
+		if i%5 == 0 {
+			slow[i] = 2 * w
+		}
+	}
+	dijkstra := runQueries(metricGraph(g, slow), queries, func(int) graph.PotentialFunc {
+		return func(int) int { return 0 }
+	})
+
+	for _, metric := range []struct {
+		name    string
+		weights []uint32
+		want    []int
+	}{{"crp", g.Weights, alt.lengths}, {"crp slow arcs", slow, dijkstra.lengths}} {
+		start = time.Now()
+		m, err := overlay.Customize(metric.weights, opts.workers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%-16s %12d bytes %10.3f s customization\n", metric.name, m.Bytes(), time.Since(start).Seconds())
+		mg := metricGraph(g, metric.weights)
+		stats := queryStats{lengths: make([]int, len(queries))}
+		for i, q := range queries {
+			start := time.Now()
+			path, seq := m.SearchSequence(q.src, q.dest)
+			stats.total += time.Since(start)
+			stats.visited += len(seq)
+			stats.lengths[i] = graph.PathLength(mg, graph.Reversed(path))
+		}
+		stats.report(metric.name, len(queries))
+		checkLengths(metric.name, stats.lengths, metric.want)
+	}
+}
+
+// Returns g with its arc weights replaced
+func metricGraph(g *graph.Graph, weights []uint32) *graph.Graph {
+	mg := *g
+	mg.Weights = weights
+	return &mg
+}
+
+func main() {
+	numQueries := flag.Int("queries", 1000, "number of random queries to run")
+	numLandmarks := flag.Int("landmarks", 16, "number of landmarks to use for ALT")
+	workers := flag.Int("workers", 0, "number of goroutines to use for preprocessing (0 uses all CPUs)")
+	delta := flag.Int("delta", 0, "bucket width for delta-stepping (0 compares several)")
+	levels := flag.Int("levels", 3, "number of partition levels for customizable route planning")
+	fanout := flag.Int("fanout", 8, "number of cells each cell is split into for customizable route planning")
+	cells := flag.Int("cells", 64, "number of cells whose cut vertices become transit nodes")
+	seed := flag.Int64("seed", 42, "random seed for landmarks and queries")
+	flag.Usage = func() {
+		names := make([]string, 0, len(experiments))
+		for name := range experiments {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] <experiment> <node file> <arc file>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "experiments: %v\n", names)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 3 || experiments[args[0]] == nil {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	rand.Seed(*seed)
+	g, err := graph.LoadGraph(args[1], args[2])
+	if err != nil {
+		log.Fatal(err)
+	}
+	queries := make([]query, *numQueries)
+	for i := range queries {
+		queries[i] = query{rand.Intn(len(g.Nodes)), rand.Intn(len(g.Nodes))}
+	}
+	experiments[args[0]](g, queries, options{
+		landmarks: *numLandmarks,
+		workers:   *workers,
+		delta:     *delta,
+		cells:     *cells,
+		levels:    *levels,
+		fanout:    *fanout,
+	})
+}
@@ -0,0 +1,138 @@
+package graph
+
+import (
+	"math"
+	"sort"
+)
+
+// Limits on which routes count as meaningful alternatives
+type AlternativeOptions struct {
+	// Maximum number of alternatives besides the shortest path
+	Max int
+	// Longest allowed alternative as a multiple of the shortest distance
+	MaxStretch float64
+	// Largest length an alternative may share with the routes picked before
+	// it, as a fraction of the shortest distance
+	MaxShared float64
+}
+
+var DefaultAlternativeOptions = AlternativeOptions{
+	Max:        3,
+	MaxStretch: 1.25,
+	MaxShared:  0.7,
+}
+
+// Chain of arcs on both the forward shortest path tree from the source and
+// the backward tree from the destination, from vertex start to vertex end
+type plateau struct {
+	start, end int
+	length     int
+}
+
+// Finds the shortest path from src to dest followed by up to opts.Max
+// alternative routes using the plateau method. reverse must be
+// graph.Reverse().
+//
+// A forward shortest path tree is grown from src and a backward tree from
+// dest. A chain of arcs in both trees (a plateau) from a to b gives the route
+// src -> a -> b -> dest of length d(src, a) + d(a, dest), which is a shortest
+// path wherever it is on the plateau. Long plateaus make routes that differ
+// from the shortest path for a long way without detours, so candidates are
+// considered from the longest plateau down and kept if they are not too much
+// longer than the shortest path and do not overlap too much with the routes
+// already picked.
+func AlternativeRoutes(graph, reverse *Graph, src, dest int, opts AlternativeOptions) []Path {
+	routes := make([]Path, 0)
+	state, _ := search(graph, src, dest, func(int) int { return 0 }, nil, nil)
+	shortest := state.Nodes[dest].Distance
+	if shortest == math.MaxInt64 {
+		return routes
+	}
+	routes = append(routes, Path{state.pathTo(dest), shortest})
+	if opts.Max <= 0 {
+		return routes
+	}
+	// Only vertices on routes within the stretch bound matter
+	bound := int(float64(shortest) * opts.MaxStretch)
+	forward, _ := searchWithin(graph, src, bound)
+	backward, _ := searchWithin(reverse, dest, bound)
+	reached := func(s *SearchState, v int) bool {
+		return s.Nodes[v].Processed
+	}
+
+	// Both trees only keep one predecessor per vertex, so an arc u -> v is on
+	// both when v's forward predecessor is u and u's backward one is v
+	onPlateau := func(u, v int) bool {
+		return reached(forward, v) && reached(backward, u) &&
+			forward.Nodes[v].Pred == u && backward.Nodes[u].Pred == v
+	}
+	plateaus := make([]plateau, 0)
+	for a := range graph.Nodes {
+		if !reached(forward, a) || !reached(backward, a) ||
+			forward.Nodes[a].Distance+backward.Nodes[a].Distance > bound {
+			continue
+		}
+		next := backward.Nodes[a].Pred
+		// Only start at the first vertex of each plateau
+		if next == -1 || !onPlateau(a, next) {
+			continue
+		}
+		if pred := forward.Nodes[a].Pred; pred != -1 && onPlateau(pred, a) {
+			continue
+		}
+		b := a
+		for n := backward.Nodes[b].Pred; n != -1 && onPlateau(b, n); n = backward.Nodes[b].Pred {
+			b = n
+		}
+		plateaus = append(plateaus, plateau{a, b, forward.Nodes[b].Distance - forward.Nodes[a].Distance})
+	}
+	sort.Slice(plateaus, func(i, j int) bool {
+		return plateaus[i].length > plateaus[j].length
+	})
+
+	// Arcs used by picked routes
+	used := make(map[[2]int]bool)
+	markUsed := func(path []int) {
+		for i := 1; i < len(path); i++ {
+			used[[2]int{path[i-1], path[i]}] = true
+		}
+	}
+	markUsed(routes[0].Vertices)
+	maxShared := int(float64(shortest) * opts.MaxShared)
+	for _, p := range plateaus {
+		if len(routes) > opts.Max {
+			break
+		}
+		// src -> start along the forward tree, then to dest along the backward tree
+		vertices := forward.pathTo(p.start)
+		for v := backward.Nodes[p.start].Pred; v != -1; v = backward.Nodes[v].Pred {
+			vertices = append(vertices, v)
+		}
+		if hasRepeat(vertices) {
+			continue
+		}
+		shared := 0
+		for i := 1; i < len(vertices); i++ {
+			if used[[2]int{vertices[i-1], vertices[i]}] {
+				shared += PathLength(graph, vertices[i-1:i+1])
+			}
+		}
+		if shared > maxShared {
+			continue
+		}
+		markUsed(vertices)
+		routes = append(routes, Path{vertices, forward.Nodes[p.start].Distance + backward.Nodes[p.start].Distance})
+	}
+	return routes
+}
+
+func hasRepeat(vertices []int) bool {
+	seen := make(map[int]bool, len(vertices))
+	for _, v := range vertices {
+		if seen[v] {
+			return true
+		}
+		seen[v] = true
+	}
+	return false
+}
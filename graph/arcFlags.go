@@ -0,0 +1,90 @@
+package graph
+
+import (
+	"math"
+)
+
+// Arc flags for a partition of a graph: an arc's flag for cell c is set if
+// the arc starts a shortest path to some vertex in c. A search towards a
+// vertex in c only needs to follow arcs flagged for c, which prunes most of
+// the graph away from the destination.
+type ArcFlags struct {
+	Partition *Partition
+	// Bitset over arcs for each cell, so a query only touches the flags of
+	// its destination's cell
+	flags [][]uint64
+}
+
+func (af *ArcFlags) has(cell, arc int) bool {
+	return af.flags[cell][arc/64]&(1<<uint(arc%64)) != 0
+}
+
+// Number of bytes used by the flags
+func (af *ArcFlags) Bytes() int {
+	total := 0
+	for _, f := range af.flags {
+		total += 8 * len(f)
+	}
+	return total
+}
+
+// Computes arc flags for partition using up to workers goroutines, one cell
+// at a time each (workers <= 0 uses all CPUs). reverse must be
+// graph.Reverse().
+//
+// Arcs inside a cell are flagged for it. Every shortest path into a cell
+// enters it for the last time through a boundary vertex b, so the remaining
+// flags come from a backward search from each boundary vertex: arc u -> v
+// is on a shortest path to b when d(u, b) = w(u, v) + d(v, b). Flagging
+// every arc that satisfies the equality, rather than only the arcs of one
+// tree, keeps paths correct when shortest paths tie.
+func NewArcFlags(graph, reverse *Graph, partition *Partition, workers int, progress ProgressFunc) *ArcFlags {
+	af := &ArcFlags{Partition: partition, flags: make([][]uint64, partition.NumCells)}
+	words := (len(graph.Heads) + 63) / 64
+	boundary := partition.boundaryVertices(graph)
+	parallelFor(partition.NumCells, workers, progress, func(c int) {
+		flags := make([]uint64, words)
+		set := func(arc int) {
+			flags[arc/64] |= 1 << uint(arc%64)
+		}
+		for u := range graph.Nodes {
+			if int(partition.Cell[u]) != c {
+				continue
+			}
+			for a := int(graph.FirstArc[u]); a < int(graph.FirstArc[u+1]); a++ {
+				if int(partition.Cell[graph.Heads[a]]) == c {
+					set(a)
+				}
+			}
+		}
+		for _, b := range boundary[c] {
+			// toB[u] = d(u, b)
+			toB := Dijkstra(reverse, b)
+			for u := range graph.Nodes {
+				if toB[u] == math.MaxInt64 {
+					continue
+				}
+				heads, weights := graph.Arcs(u)
+				first := int(graph.FirstArc[u])
+				for i, v := range heads {
+					if toB[v] != math.MaxInt64 && toB[u] == int(weights[i])+toB[v] {
+						set(first + i)
+					}
+				}
+			}
+		}
+		af.flags[c] = flags
+	})
+	return af
+}
+
+// Runs Dijkstra's algorithm from src to dest following only arcs flagged
+// for dest's cell. Returns the reverse of the shortest path and the
+// sequence of vertices visited like SearchSequence.
+func (af *ArcFlags) SearchSequence(graph *Graph, src, dest int) ([]int, []int) {
+	cell := int(af.Partition.Cell[dest])
+	state, visitSeq := search(graph, src, dest, func(int) int { return 0 }, func(u, arc, distance int) bool {
+		return !af.has(cell, arc)
+	}, nil)
+	return state.reversePathTo(src, dest), visitSeq
+}
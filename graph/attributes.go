@@ -0,0 +1,232 @@
+package graph
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Attributes of a single arc
+type ArcAttribute struct {
+	Class RoadClass
+	// Name of the road, empty if unknown
+	Name string
+	// Speed limit in km/h, 0 if unknown
+	SpeedLimit int
+	Toll       bool
+	// Stable ID of the arc in the source data (like a way ID shared by the
+	// arcs of one road), -1 if unknown
+	ID int64
+}
+
+// Optional attributes of every arc, indexed like Heads. Most arcs share a
+// handful of names, so names are stored once and arcs keep an index, and
+// fields no arc has are not stored at all. Without names and IDs this takes
+// 3 bytes per arc.
+type ArcAttributes struct {
+	Classes []RoadClass
+	// Speed limits in km/h, 0 where unknown
+	SpeedLimits []uint8
+	// Bit set of arcToll and future flags
+	flags []uint8
+	// Index into names of each arc's name, nil if no arc has a name
+	nameIndices []uint32
+	// Distinct names, starting with the empty name
+	names []string
+	// Stable ID of each arc, nil if no arc has one
+	ids []int64
+}
+
+const arcToll = 1
+
+// Returns attributes for numArcs arcs, all unclassified and unnamed
+func newArcAttributes(numArcs int) *ArcAttributes {
+	return &ArcAttributes{
+		Classes:     make([]RoadClass, numArcs),
+		SpeedLimits: make([]uint8, numArcs),
+		flags:       make([]uint8, numArcs),
+		names:       []string{""},
+	}
+}
+
+// Returns the attributes of an arc
+func (a *ArcAttributes) Arc(arc int) ArcAttribute {
+	attr := ArcAttribute{
+		Class:      a.Classes[arc],
+		SpeedLimit: int(a.SpeedLimits[arc]),
+		Toll:       a.flags[arc]&arcToll != 0,
+		ID:         -1,
+	}
+	if a.nameIndices != nil {
+		attr.Name = a.names[a.nameIndices[arc]]
+	}
+	if a.ids != nil {
+		attr.ID = a.ids[arc]
+	}
+	return attr
+}
+
+// Number of bytes used to store the attributes, not counting the names
+func (a *ArcAttributes) Bytes() int {
+	return len(a.Classes) + len(a.SpeedLimits) + len(a.flags) + 4*len(a.nameIndices) + 8*len(a.ids)
+}
+
+// Returns the attributes of the arcs of a graph whose arc i was arc
+// oldArcs[i] of the graph these belong to
+func (a *ArcAttributes) permute(oldArcs []int32) *ArcAttributes {
+	p := newArcAttributes(len(oldArcs))
+	p.names = a.names
+	if a.nameIndices != nil {
+		p.nameIndices = make([]uint32, len(oldArcs))
+	}
+	if a.ids != nil {
+		p.ids = make([]int64, len(oldArcs))
+	}
+	for i, old := range oldArcs {
+		p.Classes[i], p.SpeedLimits[i], p.flags[i] = a.Classes[old], a.SpeedLimits[old], a.flags[old]
+		if a.nameIndices != nil {
+			p.nameIndices[i] = a.nameIndices[old]
+		}
+		if a.ids != nil {
+			p.ids[i] = a.ids[old]
+		}
+	}
+	return p
+}
+
+// Loads attributes for the graph's arcs from a file of lines
+//
+//	c <comment>
+//	a <src> <dest> <weight> <key>=<value> ...
+//	e <src> <dest> <key>=<value> ...
+//
+// where src and dest are the 1 based vertex IDs of the arc file. This reads
+// arc files extended with attributes after each weight (the weights are
+// ignored, so the graph can be loaded from the same file) as well as side
+// files listing only arcs with attributes. Keys are class (a road class name
+// like motorway), speed (the speed limit in km/h), toll (true or false), id
+// (a stable arc ID) and name, which must come last since its value runs to
+// the end of the line. Each line is matched to an arc with the same
+// endpoints; parallel arcs are matched in the order they appear. Arcs that
+// are not listed are unclassified and unnamed.
+func (g *Graph) LoadArcAttributes(attributeFile string) error {
+	f, err := os.Open(attributeFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	attrs := newArcAttributes(len(g.Heads))
+	nameIndex := map[string]uint32{"": 0}
+	matched := make([]bool, len(g.Heads))
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, name := scanner.Text(), ""
+		if i := strings.Index(line, " name="); i != -1 {
+			line, name = line[:i], strings.TrimSpace(line[i+len(" name="):])
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == "c" || fields[0] == "p" {
+			continue
+		}
+		numEndpoints := 3
+		if fields[0] == "a" {
+			numEndpoints = 4
+		} else if fields[0] != "e" {
+			return fmt.Errorf("line %d: expected a <src> <dest> <weight> <attributes> or e <src> <dest> <attributes>", lineNum)
+		}
+		if len(fields) < numEndpoints {
+			return fmt.Errorf("line %d: missing endpoints", lineNum)
+		}
+		src, err1 := strconv.Atoi(fields[1])
+		dest, err2 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("line %d: invalid index", lineNum)
+		}
+		u, v := g.Vertex(src-1), g.Vertex(dest-1)
+		if u == -1 || v == -1 {
+			return fmt.Errorf("line %d: invalid index", lineNum)
+		}
+		arc := g.firstUnmatchedArc(u, v, matched)
+		if arc == -1 {
+			return fmt.Errorf("line %d: no arc from %d to %d", lineNum, src, dest)
+		}
+		matched[arc] = true
+
+		for _, field := range fields[numEndpoints:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("line %d: expected <key>=<value>, got %q", lineNum, field)
+			}
+			if err := attrs.set(arc, kv[0], kv[1]); err != nil {
+				return fmt.Errorf("line %d: %v", lineNum, err)
+			}
+		}
+		if name != "" {
+			i, ok := nameIndex[name]
+			if !ok {
+				if len(attrs.names) == math.MaxUint32 {
+					return fmt.Errorf("line %d: too many names", lineNum)
+				}
+				i = uint32(len(attrs.names))
+				nameIndex[name] = i
+				attrs.names = append(attrs.names, name)
+			}
+			if attrs.nameIndices == nil {
+				attrs.nameIndices = make([]uint32, len(g.Heads))
+			}
+			attrs.nameIndices[arc] = i
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	g.Attributes = attrs
+	return nil
+}
+
+// Sets the attribute named key of an arc from its value in a file
+func (a *ArcAttributes) set(arc int, key, value string) error {
+	switch key {
+	case "class":
+		class, err := ParseRoadClass(value)
+		if err != nil {
+			return err
+		}
+		a.Classes[arc] = class
+	case "speed":
+		speed, err := strconv.Atoi(value)
+		if err != nil || speed < 0 || speed > math.MaxUint8 {
+			return fmt.Errorf("invalid speed limit %q", value)
+		}
+		a.SpeedLimits[arc] = uint8(speed)
+	case "toll":
+		toll, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid toll flag %q", value)
+		}
+		a.flags[arc] &^= arcToll
+		if toll {
+			a.flags[arc] |= arcToll
+		}
+	case "id":
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || id < 0 {
+			return fmt.Errorf("invalid id %q", value)
+		}
+		if a.ids == nil {
+			a.ids = make([]int64, len(a.Classes))
+			for i := range a.ids {
+				a.ids[i] = -1
+			}
+		}
+		a.ids[arc] = id
+	default:
+		return errors.New("unknown attribute " + key)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Rectangle of coordinates between two corners
+type Box struct {
+	Min Cord
+	Max Cord
+}
+
+// Returns the box spanned by two opposite corners in any order
+func NewBox(a, b Cord) Box {
+	return Box{
+		Min: Cord{Lat: minInt(a.Lat, b.Lat), Long: minInt(a.Long, b.Long)},
+		Max: Cord{Lat: maxInt(a.Lat, b.Lat), Long: maxInt(a.Long, b.Long)},
+	}
+}
+
+// Reports whether c is inside the box or on its edge
+func (b Box) Contains(c Cord) bool {
+	return b.Min.Lat <= c.Lat && c.Lat <= b.Max.Lat && b.Min.Long <= c.Long && c.Long <= b.Max.Long
+}
+
+// Bounding box of the polygon's outer ring
+func (p Polygon) box() Box {
+	box := Box{Min: p[0][0], Max: p[0][0]}
+	for _, c := range p[0] {
+		box.Min.Lat, box.Max.Lat = minInt(box.Min.Lat, c.Lat), maxInt(box.Max.Lat, c.Lat)
+		box.Min.Long, box.Max.Long = minInt(box.Min.Long, c.Long), maxInt(box.Max.Long, c.Long)
+	}
+	return box
+}
+
+// Areas and arcs a search must not use. Vertices inside a box or polygon are
+// not entered, except for the destination so routes can end inside an area.
+// A source inside an area can still leave it along arcs to vertices outside.
+type Avoid struct {
+	Boxes    []Box
+	Polygons []Polygon
+	// Every arc from the first to the second vertex of each pair is avoided
+	Arcs [][2]int
+	// Whether each vertex is inside an area, set by Prepare
+	inArea []bool
+}
+
+// Checks that every polygon's outer ring has at least three corners and
+// every arc exists
+func (a *Avoid) Validate(graph *Graph) error {
+	for _, p := range a.Polygons {
+		if len(p) == 0 || len(p[0]) < 4 {
+			return errors.New("polygon with fewer than 3 corners")
+		}
+	}
+	for _, e := range a.Arcs {
+		if e[0] < 0 || e[0] >= len(graph.Nodes) || len(graph.ArcsBetween(e[0], e[1])) == 0 {
+			return fmt.Errorf("no arc from %d to %d", graph.OriginalID(e[0])+1, graph.OriginalID(e[1])+1)
+		}
+	}
+	return nil
+}
+
+// Works out which vertices of graph are inside an area, so the searches
+// using the avoid (like every leg of a route through via points) do not
+// each check every vertex. It then works for any graph with the same
+// vertices. The areas must not change afterwards.
+func (a *Avoid) Prepare(graph *Graph) {
+	a.inArea = a.areaVertices(graph)
+}
+
+// Returns whether each vertex of graph is inside an area, checking polygons
+// only for vertices inside their bounding boxes
+func (a *Avoid) areaVertices(graph *Graph) []bool {
+	inArea := make([]bool, len(graph.Nodes))
+	polygonBoxes := make([]Box, len(a.Polygons))
+	for i, p := range a.Polygons {
+		polygonBoxes[i] = p.box()
+	}
+	for v, c := range graph.Nodes {
+		for _, b := range a.Boxes {
+			inArea[v] = inArea[v] || b.Contains(c)
+		}
+		for i, p := range a.Polygons {
+			inArea[v] = inArea[v] || polygonBoxes[i].Contains(c) && p.Contains(c)
+		}
+	}
+	return inArea
+}
+
+// Returns a filter skipping the avoided arcs of a search towards dest, or
+// nil if nothing is avoided. Vertices inside an area come from Prepare, or
+// are worked out here if it was not called.
+func (a *Avoid) filter(graph *Graph, dest int) arcFilter {
+	if a == nil || len(a.Boxes) == 0 && len(a.Polygons) == 0 && len(a.Arcs) == 0 {
+		return nil
+	}
+	inArea := a.inArea
+	if len(inArea) != len(graph.Nodes) {
+		inArea = a.areaVertices(graph)
+	}
+	arcs := make(map[int]bool)
+	for _, e := range a.Arcs {
+		for _, arc := range graph.ArcsBetween(e[0], e[1]) {
+			arcs[int(arc)] = true
+		}
+	}
+	return func(u, arc, distance int) bool {
+		v := int(graph.Heads[arc])
+		return arcs[arc] || inArea[v] && v != dest
+	}
+}
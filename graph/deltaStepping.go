@@ -0,0 +1,139 @@
+package graph
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// Bucket width used by DeltaStepping when none is given: the mean arc
+// weight, so a bucket holds vertices about one arc apart
+func DefaultDelta(graph *Graph) int {
+	return meanArcWeight(graph)
+}
+
+// Mean arc weight rounded down, at least 1
+func meanArcWeight(graph *Graph) int {
+	if len(graph.Weights) == 0 {
+		return 1
+	}
+	total := 0
+	for _, w := range graph.Weights {
+		total += int(w)
+	}
+	return maxInt(total/len(graph.Weights), 1)
+}
+
+// Computes distances from src to every vertex like Dijkstra using
+// delta-stepping on up to workers goroutines (workers <= 0 uses all CPUs).
+// delta <= 0 uses DefaultDelta.
+//
+// Vertices are kept in buckets of tentative distance delta wide. The lowest
+// bucket is emptied in phases that relax the light arcs (weight <= delta)
+// of all its vertices at once, since those can put vertices back into the
+// same bucket. Heavy arcs can only reach later buckets, so they are relaxed
+// once the bucket stays empty. Each phase splits the bucket between workers
+// which lower distances with compare and swap. Small delta does more phases
+// with less parallel work each, large delta relaxes arcs from vertices whose
+// distance is not final yet.
+func DeltaStepping(graph *Graph, src, delta, workers int) []int {
+	workers = defaultWorkers(workers)
+	if delta <= 0 {
+		delta = DefaultDelta(graph)
+	}
+	n := len(graph.Nodes)
+	dist := make([]int64, n)
+	for i := range dist {
+		dist[i] = math.MaxInt64
+	}
+	dist[src] = 0
+
+	// Relaxes the light or heavy arcs leaving frontier and returns the
+	// vertices whose distance went down (possibly more than once)
+	relax := func(frontier []int32, light bool) []int32 {
+		chunks := workers
+		if len(frontier) < minParallelFrontier {
+			chunks = 1
+		}
+		updated := make([][]int32, chunks)
+		var wg sync.WaitGroup
+		for c := 0; c < chunks; c++ {
+			wg.Add(1)
+			go func(c int) {
+				defer wg.Done()
+				lo := c * len(frontier) / chunks
+				hi := (c + 1) * len(frontier) / chunks
+				for _, u := range frontier[lo:hi] {
+					du := atomic.LoadInt64(&dist[u])
+					heads, weights := graph.Arcs(int(u))
+					for i, head := range heads {
+						if weights[i] == ArcClosed || (int(weights[i]) <= delta) != light {
+							continue
+						}
+						candidate := du + int64(weights[i])
+						for {
+							old := atomic.LoadInt64(&dist[head])
+							if candidate >= old {
+								break
+							}
+							if atomic.CompareAndSwapInt64(&dist[head], old, candidate) {
+								updated[c] = append(updated[c], head)
+								break
+							}
+						}
+					}
+				}
+			}(c)
+		}
+		wg.Wait()
+		all := make([]int32, 0)
+		for _, part := range updated {
+			all = append(all, part...)
+		}
+		return all
+	}
+
+	buckets := [][]int32{{int32(src)}}
+	place := func(vertices []int32) {
+		for _, v := range vertices {
+			b := int(dist[v]) / delta
+			for b >= len(buckets) {
+				buckets = append(buckets, nil)
+			}
+			buckets[b] = append(buckets[b], v)
+		}
+	}
+	// Phase (or bucket) in which each vertex was last added to a frontier, so
+	// buckets can hold duplicates and stale entries
+	inFrontier := make([]int, n)
+	inRemoved := make([]int, n)
+	phase := 0
+	for b := 0; b < len(buckets); b++ {
+		removed := make([]int32, 0)
+		for len(buckets[b]) > 0 {
+			phase++
+			frontier := make([]int32, 0, len(buckets[b]))
+			for _, v := range buckets[b] {
+				if int(dist[v])/delta == b && inFrontier[v] != phase {
+					inFrontier[v] = phase
+					frontier = append(frontier, v)
+				}
+			}
+			buckets[b] = nil
+			for _, v := range frontier {
+				if inRemoved[v] != b+1 {
+					inRemoved[v] = b + 1
+					removed = append(removed, v)
+				}
+			}
+			place(relax(frontier, true))
+		}
+		place(relax(removed, false))
+	}
+
+	distances := make([]int, n)
+	for i, d := range dist {
+		distances[i] = int(d)
+	}
+	return distances
+}
@@ -51,9 +51,232 @@ type Dest struct {
 	Dist int
 }
 
+// Directed graph stored in compressed sparse row form. The arcs leaving
+// vertex u have indices FirstArc[u] to FirstArc[u+1]-1, ordered as they
+// appeared in the arc file. Arc a goes to Heads[a] and has weight Weights[a].
+// This takes 8 bytes per arc and 4 per vertex instead of a slice header per
+// vertex and 16 bytes per arc for [][]Dest.
 type Graph struct {
-	Nodes          []Cord
-	AdjacencyLists [][]Dest
+	Nodes    []Cord
+	FirstArc []int32
+	Heads    []int32
+	Weights  []uint32
+	// Optional second cost of each arc, such as travel time when Weights are
+	// distances (nil if not loaded)
+	SecondWeights []uint32
+	// Optional attributes of each arc, such as road names (nil if not
+	// loaded)
+	Attributes *ArcAttributes
+	// Maps between vertex indices and indices in the input files when the
+	// vertices have been reordered (nil otherwise)
+	originalIDs []int32
+	vertexIDs   []int32
+}
+
+// Weight of an arc that cannot be used, like a closed road. Searches skip
+// these arcs.
+const ArcClosed = math.MaxUint32
+
+func (g *Graph) NumVertices() int {
+	return len(g.Nodes)
+}
+
+func (g *Graph) NumArcs() int {
+	return len(g.Heads)
+}
+
+// Returns the heads and weights of the arcs leaving u
+func (g *Graph) Arcs(u int) ([]int32, []uint32) {
+	first, last := g.FirstArc[u], g.FirstArc[u+1]
+	return g.Heads[first:last], g.Weights[first:last]
+}
+
+// Returns the indices of the arcs from u to v in the order they leave u
+func (g *Graph) ArcsBetween(u, v int) []int32 {
+	arcs := make([]int32, 0)
+	for a := g.FirstArc[u]; a < g.FirstArc[u+1]; a++ {
+		if int(g.Heads[a]) == v {
+			arcs = append(arcs, a)
+		}
+	}
+	return arcs
+}
+
+// Returns the arcs leaving u in the old adjacency list form
+func (g *Graph) AdjacencyList(u int) []Dest {
+	heads, weights := g.Arcs(u)
+	adjList := make([]Dest, len(heads))
+	for i, v := range heads {
+		adjList[i] = Dest{int(v), int(weights[i])}
+	}
+	return adjList
+}
+
+// Returns every vertex's adjacency list. This allocates the whole
+// [][]Dest representation so it is only meant for code that has not
+// been ported to the compressed form.
+func (g *Graph) AdjacencyLists() [][]Dest {
+	adjLists := make([][]Dest, len(g.Nodes))
+	for u := range adjLists {
+		adjLists[u] = g.AdjacencyList(u)
+	}
+	return adjLists
+}
+
+// New weight for every arc from Src to Dest (vertex indices), ArcClosed to
+// close them
+type ArcUpdate struct {
+	Src    int
+	Dest   int
+	Weight uint32
+}
+
+// Returns a copy of the graph with the updates applied in order, and whether
+// no arc got cheaper. The copy shares everything but the weights with g, so
+// arc indices stay the same and searches running on g are not affected.
+// When no arc got cheaper, potentials that are feasible for g (like landmark
+// potentials) stay feasible for the copy, since pi(u) - pi(v) <= w(u, v) <=
+// w'(u, v). Returns g itself if no weight changes.
+func (g *Graph) UpdateArcs(updates []ArcUpdate) (*Graph, bool, error) {
+	updated := *g
+	updated.Weights = append([]uint32(nil), g.Weights...)
+	changed := make([]int32, 0)
+	for _, u := range updates {
+		if u.Src < 0 || u.Src >= len(g.Nodes) || u.Dest < 0 || u.Dest >= len(g.Nodes) {
+			return nil, false, errors.New("vertex out of range")
+		}
+		arcs := g.ArcsBetween(u.Src, u.Dest)
+		for _, a := range arcs {
+			updated.Weights[a] = u.Weight
+		}
+		changed = append(changed, arcs...)
+		if len(arcs) == 0 {
+			return nil, false, fmt.Errorf("no arc from %d to %d", g.OriginalID(u.Src)+1, g.OriginalID(u.Dest)+1)
+		}
+	}
+	same := true
+	for _, a := range changed {
+		if updated.Weights[a] < g.Weights[a] {
+			return &updated, false, nil
+		}
+		same = same && updated.Weights[a] == g.Weights[a]
+	}
+	if same {
+		return g, true, nil
+	}
+	return &updated, true, nil
+}
+
+// Returns the graph with every arc reversed
+func (g *Graph) Reverse() *Graph {
+	r, _ := g.reverse()
+	return r
+}
+
+// Returns the reversed graph and, for each of its arcs, the index of the
+// arc it was made from
+func (g *Graph) reverse() (*Graph, []int32) {
+	r := &Graph{
+		Nodes:       g.Nodes,
+		FirstArc:    make([]int32, len(g.FirstArc)),
+		Heads:       make([]int32, len(g.Heads)),
+		Weights:     make([]uint32, len(g.Weights)),
+		originalIDs: g.originalIDs,
+		vertexIDs:   g.vertexIDs,
+	}
+	if g.SecondWeights != nil {
+		r.SecondWeights = make([]uint32, len(g.SecondWeights))
+	}
+	forwardArc := make([]int32, len(g.Heads))
+	for _, v := range g.Heads {
+		r.FirstArc[v+1]++
+	}
+	for u := 0; u < len(g.Nodes); u++ {
+		r.FirstArc[u+1] += r.FirstArc[u]
+	}
+	next := make([]int32, len(g.Nodes))
+	copy(next, r.FirstArc)
+	for u := 0; u < len(g.Nodes); u++ {
+		for a := g.FirstArc[u]; a < g.FirstArc[u+1]; a++ {
+			v := g.Heads[a]
+			i := next[v]
+			next[v]++
+			r.Heads[i] = int32(u)
+			r.Weights[i] = g.Weights[a]
+			if g.SecondWeights != nil {
+				r.SecondWeights[i] = g.SecondWeights[a]
+			}
+			forwardArc[i] = a
+		}
+	}
+	return r, forwardArc
+}
+
+// Builds a graph from adjacency lists
+func NewGraph(nodes []Cord, adjLists [][]Dest) (*Graph, error) {
+	if len(adjLists) != len(nodes) || len(nodes) > math.MaxInt32 {
+		return nil, errors.New("invalid number of vertices")
+	}
+	arcs := make(arcList, 0)
+	for u, adjList := range adjLists {
+		for _, dest := range adjList {
+			if err := arcs.add(len(nodes), u, dest.Dest, dest.Dist); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return newGraph(nodes, arcs)
+}
+
+// Arc waiting to be put into compressed rows
+type pendingArc struct {
+	src, dest int32
+	dist      uint32
+}
+
+type arcList []pendingArc
+
+// Checks an arc between 0 based vertex indices and appends it
+func (arcs *arcList) add(numVertices, src, dest, dist int) error {
+	if src >= numVertices || src < 0 || dest >= numVertices || dest < 0 {
+		return errors.New("invalid index")
+	}
+	if dist < 0 || dist > math.MaxUint32 {
+		return errors.New("invalid arc weight")
+	}
+	if len(*arcs) == math.MaxInt32 {
+		return errors.New("too many arcs")
+	}
+	*arcs = append(*arcs, pendingArc{int32(src), int32(dest), uint32(dist)})
+	return nil
+}
+
+// Builds compressed rows, keeping the order of arcs with the same source
+func newGraph(nodes []Cord, arcs arcList) (*Graph, error) {
+	if len(nodes) > math.MaxInt32 {
+		return nil, errors.New("too many vertices")
+	}
+	g := &Graph{
+		Nodes:    nodes,
+		FirstArc: make([]int32, len(nodes)+1),
+		Heads:    make([]int32, len(arcs)),
+		Weights:  make([]uint32, len(arcs)),
+	}
+	for _, a := range arcs {
+		g.FirstArc[a.src+1]++
+	}
+	for u := 0; u < len(nodes); u++ {
+		g.FirstArc[u+1] += g.FirstArc[u]
+	}
+	next := make([]int32, len(nodes))
+	copy(next, g.FirstArc)
+	for _, a := range arcs {
+		i := next[a.src]
+		next[a.src]++
+		g.Heads[i] = a.dest
+		g.Weights[i] = a.dist
+	}
+	return g, nil
 }
 
 func loadCords(in io.Reader) ([]Cord, error) {
@@ -80,10 +303,12 @@ func LoadGraph(cordFile, arcFile string) (*Graph, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer cf.Close()
 	af, err := os.Open(arcFile)
 	if err != nil {
 		return nil, err
 	}
+	defer af.Close()
 
 	// Read cordinates
 	cords, err := loadCords(cf)
@@ -91,13 +316,8 @@ func LoadGraph(cordFile, arcFile string) (*Graph, error) {
 		return nil, err
 	}
 
-	// Set up adjacency lists
-	adjLists := make([][]Dest, 0)
-	for _ = range cords {
-		adjLists = append(adjLists, make([]Dest, 0))
-	}
-
 	var src, dest, dist int
+	arcs := make(arcList, 0)
 	scanner := bufio.NewScanner(af)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -106,17 +326,72 @@ func LoadGraph(cordFile, arcFile string) (*Graph, error) {
 				return nil, err
 			}
 			// convert to 0 based indexing
-			src--
-			dest--
-			if src >= len(cords) || src < 0 || dest >= len(cords) || dest < 0 {
-				return nil, errors.New("invalid index")
+			if err := arcs.add(len(cords), src-1, dest-1, dist); err != nil {
+				return nil, err
 			}
-
-			adjLists[src] = append(adjLists[src], Dest{dest, dist})
 		}
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
-	return &Graph{Nodes: cords, AdjacencyLists: adjLists}, nil
+	return newGraph(cords, arcs)
+}
+
+// Loads a second cost for every arc from an arc file in the same format as
+// the one the graph was loaded from. Each line is matched to an arc with the
+// same endpoints; parallel arcs are matched in the order they appear.
+func (g *Graph) LoadSecondWeights(arcFile string) error {
+	af, err := os.Open(arcFile)
+	if err != nil {
+		return err
+	}
+	defer af.Close()
+
+	secondWeights := make([]uint32, len(g.Heads))
+	matched := make([]bool, len(g.Heads))
+	numMatched := 0
+	var src, dest, dist int
+	scanner := bufio.NewScanner(af)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "a ") {
+			continue
+		}
+		if _, err := fmt.Sscanf(line, "a %d %d %d", &src, &dest, &dist); err != nil {
+			return err
+		}
+		u, v := g.Vertex(src-1), g.Vertex(dest-1)
+		if u == -1 || v == -1 {
+			return errors.New("invalid index")
+		}
+		if dist < 0 || dist > math.MaxUint32 {
+			return errors.New("invalid arc weight")
+		}
+		arc := g.firstUnmatchedArc(u, v, matched)
+		if arc == -1 {
+			return fmt.Errorf("no arc from %d to %d", src, dest)
+		}
+		matched[arc] = true
+		numMatched++
+		secondWeights[arc] = uint32(dist)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if numMatched != len(g.Heads) {
+		return fmt.Errorf("second cost missing for %d arcs", len(g.Heads)-numMatched)
+	}
+	g.SecondWeights = secondWeights
+	return nil
+}
+
+// Returns the first arc from u to v not marked in matched, or -1, for
+// matching lines of a file to parallel arcs in order
+func (g *Graph) firstUnmatchedArc(u, v int, matched []bool) int {
+	for _, a := range g.ArcsBetween(u, v) {
+		if !matched[a] {
+			return int(a)
+		}
+	}
+	return -1
 }
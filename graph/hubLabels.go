@@ -0,0 +1,465 @@
+package graph
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// Hub labels: every vertex v keeps a forward label of hubs h with d(v, h)
+// and a backward label of hubs h with d(h, v), chosen so that every pair
+// s, t shares a hub on a shortest path from s to t. Then
+//
+//	d(s, t) = min over hubs h in both labels of d(s, h) + d(h, t)
+//
+// which takes a merge of two short sorted lists instead of a search.
+
+// Entry of a vertex's label
+type hubEntry struct {
+	// Rank of the hub in the order labels were built in
+	Hub  int32
+	Dist uint32
+	// Next vertex on the shortest path towards the hub (forward labels) or
+	// previous one on the path from it (backward labels), -1 for the hub
+	// itself. Fields are exported so encoding/binary can read them.
+	Parent int32
+}
+
+// Hub labels of every vertex stored in compressed rows like Graph. Entries
+// of each label are sorted by hub rank.
+type HubLabels struct {
+	// Vertex with each rank
+	order []int32
+	// Labels of vertex v are entries first[v] to first[v+1]-1
+	forwardFirst  []int64
+	forward       []hubEntry
+	backwardFirst []int64
+	backward      []hubEntry
+	numArcs       int
+	// graphFingerprint of the graph the labels were built for
+	fingerprint uint64
+}
+
+// Hashes the arcs, weights and vertex order of a graph, so labels saved for
+// it are not loaded for a graph with other weights or another vertex order
+func graphFingerprint(graph *Graph) uint64 {
+	h := fnv.New64a()
+	for _, part := range []interface{}{graph.FirstArc, graph.Heads, graph.Weights, graph.originalIDs} {
+		binary.Write(h, binary.LittleEndian, part)
+	}
+	return h.Sum64()
+}
+
+// Returns vertices from most to least important by how many shortest paths
+// pass through them, estimated by counting descendants in shortest path
+// trees from samples random roots, using up to workers goroutines
+func HubOrder(graph *Graph, samples, workers int) []int {
+	n := len(graph.Nodes)
+	coverage := make([]int, n)
+	var mu sync.Mutex
+	roots := make([]int, samples)
+	for i := range roots {
+		roots[i] = rand.Intn(n)
+	}
+	parallelFor(samples, workers, nil, func(i int) {
+		// Settles every reachable vertex since -1 is never reached
+		state, settled := search(graph, roots[i], -1, func(int) int { return 0 }, nil, nil)
+		descendants := make([]int, n)
+		for j := len(settled) - 1; j >= 0; j-- {
+			v := settled[j]
+			descendants[v]++
+			if p := state.Nodes[v].Pred; p != -1 {
+				descendants[p] += descendants[v]
+			}
+		}
+		mu.Lock()
+		for v, d := range descendants {
+			coverage[v] += d
+		}
+		mu.Unlock()
+	})
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if coverage[a] != coverage[b] {
+			return coverage[a] > coverage[b]
+		}
+		return graph.FirstArc[a+1]-graph.FirstArc[a] > graph.FirstArc[b+1]-graph.FirstArc[b]
+	})
+	return order
+}
+
+// Builds hub labels with pruned landmark labeling: vertices are taken in
+// order and each runs a forward and a backward Dijkstra that adds itself as
+// a hub to the labels of the vertices it reaches, except that the search
+// stops at any vertex whose distance the labels built so far already give.
+// Important vertices early in order cover most shortest paths, so later
+// searches are pruned quickly and labels stay small.
+func NewHubLabels(graph *Graph, order []int, progress ProgressFunc) (*HubLabels, error) {
+	n := len(graph.Nodes)
+	if len(order) != n {
+		return nil, errors.New("order must contain every vertex")
+	}
+	reverse := graph.Reverse()
+	forward := make([][]hubEntry, n)
+	backward := make([][]hubEntry, n)
+
+	// Distances from (or to) the current hub through its own label's hubs,
+	// indexed by hub rank
+	hubDist := make([]int, n)
+	for i := range hubDist {
+		hubDist[i] = math.MaxInt64
+	}
+	dist := make([]int, n)
+	parent := make([]int32, n)
+	for i := range dist {
+		dist[i] = math.MaxInt64
+	}
+	touched := make([]int32, 0)
+	queue := make(reachQueue, 0)
+
+	// Searches g from the hub with the given rank, adding it to labels of the
+	// reached vertices unless other holds a label entry that already covers
+	// the pair
+	prunedSearch := func(g *Graph, rank int, own, other [][]hubEntry, labels [][]hubEntry) error {
+		h := int(order[rank])
+		for _, e := range own[h] {
+			hubDist[e.Hub] = int(e.Dist)
+		}
+		dist[h], parent[h] = 0, -1
+		touched = append(touched, int32(h))
+		heap.Push(&queue, reachEntry{0, 0, int32(h)})
+		for queue.Len() > 0 {
+			e := heap.Pop(&queue).(reachEntry)
+			v := int(e.vertex)
+			if e.dist != dist[v] {
+				continue
+			}
+			covered := false
+			for _, l := range other[v] {
+				if hubDist[l.Hub] != math.MaxInt64 && hubDist[l.Hub]+int(l.Dist) <= e.dist {
+					covered = true
+					break
+				}
+			}
+			if covered {
+				continue
+			}
+			if e.dist > math.MaxUint32 {
+				return errors.New("distance too large for hub labels")
+			}
+			labels[v] = append(labels[v], hubEntry{int32(rank), uint32(e.dist), parent[v]})
+			heads, weights := g.Arcs(v)
+			for i, head := range heads {
+				d := e.dist + int(weights[i])
+				if d < dist[head] {
+					if dist[head] == math.MaxInt64 {
+						touched = append(touched, head)
+					}
+					dist[head], parent[head] = d, int32(v)
+					heap.Push(&queue, reachEntry{d, 0, head})
+				}
+			}
+		}
+		for _, e := range own[h] {
+			hubDist[e.Hub] = math.MaxInt64
+		}
+		for _, v := range touched {
+			dist[v] = math.MaxInt64
+		}
+		touched, queue = touched[:0], queue[:0]
+		return nil
+	}
+
+	for rank := range order {
+		// Paths from the hub end in backward labels; the hub's own forward
+		// label gives d(hub, g) for hubs g ranked before it
+		if err := prunedSearch(graph, rank, forward, backward, backward); err != nil {
+			return nil, err
+		}
+		if err := prunedSearch(reverse, rank, backward, forward, forward); err != nil {
+			return nil, err
+		}
+		if progress != nil && ((rank+1)%maxInt(n/100, 1) == 0 || rank == n-1) {
+			progress(rank+1, n)
+		}
+	}
+
+	hl := &HubLabels{order: make([]int32, n), numArcs: len(graph.Heads), fingerprint: graphFingerprint(graph)}
+	for i, v := range order {
+		hl.order[i] = int32(v)
+	}
+	hl.forwardFirst, hl.forward = flattenLabels(forward)
+	hl.backwardFirst, hl.backward = flattenLabels(backward)
+	return hl, nil
+}
+
+func flattenLabels(labels [][]hubEntry) ([]int64, []hubEntry) {
+	first := make([]int64, len(labels)+1)
+	for v, l := range labels {
+		first[v+1] = first[v] + int64(len(l))
+	}
+	entries := make([]hubEntry, 0, first[len(labels)])
+	for _, l := range labels {
+		entries = append(entries, l...)
+	}
+	return first, entries
+}
+
+func (hl *HubLabels) forwardLabel(v int) []hubEntry {
+	return hl.forward[hl.forwardFirst[v]:hl.forwardFirst[v+1]]
+}
+
+func (hl *HubLabels) backwardLabel(v int) []hubEntry {
+	return hl.backward[hl.backwardFirst[v]:hl.backwardFirst[v+1]]
+}
+
+// Returns the best common hub of s's forward and t's backward labels and the
+// distance through it, or -1 and math.MaxInt64 if there is none
+func (hl *HubLabels) meet(s, t int) (int32, int) {
+	out, in := hl.forwardLabel(s), hl.backwardLabel(t)
+	best, hub := math.MaxInt64, int32(-1)
+	for i, j := 0, 0; i < len(out) && j < len(in); {
+		switch {
+		case out[i].Hub < in[j].Hub:
+			i++
+		case out[i].Hub > in[j].Hub:
+			j++
+		default:
+			if d := int(out[i].Dist) + int(in[j].Dist); d < best {
+				best, hub = d, out[i].Hub
+			}
+			i++
+			j++
+		}
+	}
+	return hub, best
+}
+
+// Returns the distance from s to t, math.MaxInt64 if t is unreachable
+func (hl *HubLabels) Distance(s, t int) int {
+	_, d := hl.meet(s, t)
+	return d
+}
+
+// Returns the entry for hub in a label, and false if the label does not have
+// the hub
+func findHub(label []hubEntry, hub int32) (hubEntry, bool) {
+	i := sort.Search(len(label), func(i int) bool { return label[i].Hub >= hub })
+	if i == len(label) || label[i].Hub != hub {
+		return hubEntry{}, false
+	}
+	return label[i], true
+}
+
+// Returns the shortest path from s to t, nil if t is unreachable. Every
+// vertex on the path from a hub to a vertex it labels also has the hub in
+// its label, so the path is followed through parent pointers one vertex at
+// a time. Labels that break this also give nil, instead of following a
+// missing parent or going round in circles.
+func (hl *HubLabels) Path(s, t int) []int {
+	hub, d := hl.meet(s, t)
+	if d == math.MaxInt64 {
+		return nil
+	}
+	hubVertex := int(hl.order[hub])
+	path := []int{s}
+	for v := s; v != hubVertex; {
+		e, ok := hl.parent(hl.forwardLabel(v), hub, len(path))
+		if !ok {
+			return nil
+		}
+		v = int(e.Parent)
+		path = append(path, v)
+	}
+	// From t back to the hub, which is already on the path
+	tail := make([]int, 0)
+	for v := t; v != hubVertex; {
+		tail = append(tail, v)
+		e, ok := hl.parent(hl.backwardLabel(v), hub, len(tail))
+		if !ok {
+			return nil
+		}
+		v = int(e.Parent)
+	}
+	for i := len(tail) - 1; i >= 0; i-- {
+		path = append(path, tail[i])
+	}
+	return path
+}
+
+// Returns the entry for hub in the label of the steps-th vertex of a path
+// being followed to the hub, and false if there is no entry, it has no
+// parent, or the path already has more steps than there are vertices
+func (hl *HubLabels) parent(label []hubEntry, hub int32, steps int) (hubEntry, bool) {
+	e, ok := findHub(label, hub)
+	if !ok || e.Parent == -1 || steps > len(hl.order) {
+		return hubEntry{}, false
+	}
+	return e, true
+}
+
+// Returns the reverse of the shortest path from s to t and the hubs in s's
+// forward label and t's backward label, which are all a query looks at,
+// like SearchSequence
+func (hl *HubLabels) SearchSequence(s, t int) ([]int, []int) {
+	hubs := make([]int, 0)
+	for _, e := range hl.forwardLabel(s) {
+		hubs = append(hubs, int(hl.order[e.Hub]))
+	}
+	for _, e := range hl.backwardLabel(t) {
+		hubs = append(hubs, int(hl.order[e.Hub]))
+	}
+	path := hl.Path(s, t)
+	if len(path) < 2 {
+		return make([]int, 0), hubs
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, hubs
+}
+
+// Computes distances from every source to every target like
+// DistanceMatrix, with one label merge per pair
+func (hl *HubLabels) DistanceMatrix(sources, targets []int) [][]int {
+	matrix := make([][]int, len(sources))
+	for i, s := range sources {
+		matrix[i] = make([]int, len(targets))
+		for j, t := range targets {
+			matrix[i][j] = hl.Distance(s, t)
+		}
+	}
+	return matrix
+}
+
+// Average number of entries per label
+func (hl *HubLabels) AverageLabelSize() float64 {
+	n := len(hl.order)
+	if n == 0 {
+		return 0
+	}
+	return float64(len(hl.forward)+len(hl.backward)) / float64(2*n)
+}
+
+// Number of bytes used by the labels
+func (hl *HubLabels) Bytes() int {
+	return 12*(len(hl.forward)+len(hl.backward)) + 8*(len(hl.forwardFirst)+len(hl.backwardFirst)) + 4*len(hl.order)
+}
+
+// Identifies files written by HubLabels.Save
+var hubLabelMagic = [4]byte{'H', 'U', 'B', '2'}
+
+// Writes the labels in a little endian binary format that LoadHubLabels
+// reads back
+func (hl *HubLabels) Save(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	header := []interface{}{hubLabelMagic, int64(len(hl.order)), int64(hl.numArcs), hl.fingerprint, hl.order}
+	for _, part := range header {
+		if err := binary.Write(w, binary.LittleEndian, part); err != nil {
+			return err
+		}
+	}
+	for _, labels := range [][]hubEntry{hl.forward, hl.backward} {
+		if err := binary.Write(w, binary.LittleEndian, int64(len(labels))); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, labels); err != nil {
+			return err
+		}
+	}
+	for _, first := range [][]int64{hl.forwardFirst, hl.backwardFirst} {
+		if err := binary.Write(w, binary.LittleEndian, first); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// Reads labels written by Save, checking that they were built for graph
+// (the same arcs, weights and vertex order) and are well formed
+func LoadHubLabels(graph *Graph, in io.Reader) (*HubLabels, error) {
+	r := bufio.NewReader(in)
+	var magic [4]byte
+	var n, numArcs int64
+	var fingerprint uint64
+	for _, part := range []interface{}{&magic, &n, &numArcs, &fingerprint} {
+		if err := binary.Read(r, binary.LittleEndian, part); err != nil {
+			return nil, err
+		}
+	}
+	if magic != hubLabelMagic {
+		return nil, errors.New("not a hub label file")
+	}
+	if n != int64(len(graph.Nodes)) || numArcs != int64(len(graph.Heads)) || fingerprint != graphFingerprint(graph) {
+		return nil, errors.New("hub labels were built for a different graph")
+	}
+	hl := &HubLabels{order: make([]int32, n), numArcs: int(numArcs), fingerprint: fingerprint}
+	if err := binary.Read(r, binary.LittleEndian, hl.order); err != nil {
+		return nil, err
+	}
+	seen := make([]bool, n)
+	for _, v := range hl.order {
+		if v < 0 || int64(v) >= n || seen[v] {
+			return nil, errors.New("hub order is not a permutation of the vertices")
+		}
+		seen[v] = true
+	}
+	for _, labels := range []*[]hubEntry{&hl.forward, &hl.backward} {
+		var size int64
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return nil, err
+		}
+		if size < 0 || size > math.MaxInt32*n {
+			return nil, errors.New("invalid label size")
+		}
+		*labels = make([]hubEntry, size)
+		if err := binary.Read(r, binary.LittleEndian, *labels); err != nil {
+			return nil, err
+		}
+	}
+	for _, first := range []*[]int64{&hl.forwardFirst, &hl.backwardFirst} {
+		*first = make([]int64, n+1)
+		if err := binary.Read(r, binary.LittleEndian, *first); err != nil {
+			return nil, err
+		}
+	}
+	// Check offsets and entries so queries cannot index out of range
+	for _, labels := range []struct {
+		first   []int64
+		entries []hubEntry
+	}{{hl.forwardFirst, hl.forward}, {hl.backwardFirst, hl.backward}} {
+		if labels.first[0] != 0 || labels.first[n] != int64(len(labels.entries)) {
+			return nil, errors.New("invalid label offsets")
+		}
+		for v := int64(0); v < n; v++ {
+			if labels.first[v+1] < labels.first[v] {
+				return nil, errors.New("invalid label offsets")
+			}
+		}
+		for _, e := range labels.entries {
+			if e.Hub < 0 || int64(e.Hub) >= n || e.Parent < -1 || int64(e.Parent) >= n {
+				return nil, errors.New("invalid label entry")
+			}
+		}
+		// Merges and findHub rely on every label being sorted by hub
+		for v := int64(0); v < n; v++ {
+			for i := labels.first[v] + 1; i < labels.first[v+1]; i++ {
+				if labels.entries[i-1].Hub >= labels.entries[i].Hub {
+					return nil, errors.New("label not sorted by hub")
+				}
+			}
+		}
+	}
+	return hl, nil
+}
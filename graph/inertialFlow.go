@@ -0,0 +1,297 @@
+package graph
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Inertial flow partitioning: vertices are sorted along a line through the
+// map, the first quarter become sources and the last quarter sinks, and a
+// minimum cut between them (by max flow with every arc as an undirected edge
+// of capacity 1) splits the vertices in two. The best of a few lines is
+// kept, and both sides are split again until cells are small enough.
+// Sources and sinks stay on their sides, so each side holds at least a
+// quarter of the vertices.
+
+// Fraction of the vertices sorted along a line used as sources, and as sinks
+const inertialFlowBalance = 0.25
+
+// Lines to sort vertices along, as latitude and longitude weights
+var inertialFlowLines = [][2]int{{1, 0}, {0, 1}, {1, 1}, {1, -1}}
+
+// Arcs around each vertex as undirected edges in compressed rows: arc a
+// appears as a at its tail and as ^a at its head
+type undirectedArcs struct {
+	first []int32
+	arcs  []int32
+	tails []int32
+}
+
+func newUndirectedArcs(graph *Graph) *undirectedArcs {
+	n := len(graph.Nodes)
+	u := &undirectedArcs{
+		first: make([]int32, n+1),
+		arcs:  make([]int32, 2*len(graph.Heads)),
+		tails: make([]int32, len(graph.Heads)),
+	}
+	for v := 0; v < n; v++ {
+		u.first[v+1] += graph.FirstArc[v+1] - graph.FirstArc[v]
+		heads, _ := graph.Arcs(v)
+		for _, head := range heads {
+			u.first[head+1]++
+		}
+	}
+	for v := 0; v < n; v++ {
+		u.first[v+1] += u.first[v]
+	}
+	next := append([]int32(nil), u.first[:n]...)
+	for v := 0; v < n; v++ {
+		for a := graph.FirstArc[v]; a < graph.FirstArc[v+1]; a++ {
+			head := graph.Heads[a]
+			u.tails[a] = int32(v)
+			u.arcs[next[v]] = a
+			next[v]++
+			u.arcs[next[head]] = ^a
+			next[head]++
+		}
+	}
+	return u
+}
+
+// Per line state for max flow on a subset of the vertices
+type flowScratch struct {
+	// Flow on each arc, positive from tail to head
+	flow []int8
+	// Role of each vertex (source, sink or neither) and the last search
+	// that reached it
+	role    []int8
+	visited []int32
+	// Arc used to reach each vertex in the last search
+	parent []int32
+	search int32
+}
+
+const (
+	flowNone int8 = iota
+	flowSource
+	flowSink
+)
+
+// Splits vertices (whose members have member[v] == id) by a minimum cut
+// between the first and last sources vertices. Returns the side of the
+// sources and the number of arcs cut.
+func (fs *flowScratch) minCut(graph *Graph, ua *undirectedArcs, vertices []int, sources int, member []int32, id int32) ([]int, int) {
+	for i, v := range vertices {
+		switch {
+		case i < sources:
+			fs.role[v] = flowSource
+		case i >= len(vertices)-sources:
+			fs.role[v] = flowSink
+		}
+	}
+	cut := 0
+	queue := make([]int32, 0, len(vertices))
+	for {
+		fs.search++
+		queue = queue[:0]
+		for _, v := range vertices[:sources] {
+			fs.visited[v], fs.parent[v] = fs.search, -1
+			queue = append(queue, int32(v))
+		}
+		sink := int32(-1)
+		for i := 0; i < len(queue) && sink == -1; i++ {
+			u := queue[i]
+			for _, e := range ua.arcs[ua.first[u]:ua.first[u+1]] {
+				var v int32
+				var residual int8
+				if e >= 0 {
+					v, residual = graph.Heads[e], 1-fs.flow[e]
+				} else {
+					v, residual = ua.tails[^e], 1+fs.flow[^e]
+				}
+				if residual <= 0 || member[v] != id || fs.visited[v] == fs.search {
+					continue
+				}
+				fs.visited[v], fs.parent[v] = fs.search, e
+				if fs.role[v] == flowSink {
+					sink = v
+					break
+				}
+				queue = append(queue, v)
+			}
+		}
+		if sink == -1 {
+			break
+		}
+		for v := sink; fs.parent[v] != -1; {
+			if e := fs.parent[v]; e >= 0 {
+				fs.flow[e]++
+				v = ua.tails[e]
+			} else {
+				fs.flow[^e]--
+				v = graph.Heads[^e]
+			}
+		}
+		cut++
+	}
+
+	side := make([]int, 0)
+	for _, v := range vertices {
+		if fs.visited[v] == fs.search {
+			side = append(side, v)
+		}
+		fs.role[v] = flowNone
+		for a := graph.FirstArc[v]; a < graph.FirstArc[v+1]; a++ {
+			fs.flow[a] = 0
+		}
+	}
+	return side, cut
+}
+
+// Splits the vertices into cells of at most cellSize vertices with inertial
+// flow, trying the lines on up to workers goroutines (workers <= 0 uses all
+// CPUs). Cells are numbered in the order of the recursion, so cells with
+// nearby numbers tend to be nearby.
+func InertialFlowPartition(graph *Graph, cellSize, workers int, progress ProgressFunc) *Partition {
+	n := len(graph.Nodes)
+	cellSize = maxInt(cellSize, 1)
+	p := &Partition{Cell: make([]int32, n)}
+	ua := newUndirectedArcs(graph)
+	scratch := make([]*flowScratch, len(inertialFlowLines))
+	for i := range scratch {
+		scratch[i] = &flowScratch{
+			flow:    make([]int8, len(graph.Heads)),
+			role:    make([]int8, n),
+			visited: make([]int32, n),
+			parent:  make([]int32, n),
+		}
+	}
+	// Vertices of the part being split have member[v] == id
+	member := make([]int32, n)
+	nextID := int32(0)
+	done := 0
+
+	var split func(vertices []int)
+	split = func(vertices []int) {
+		if len(vertices) <= cellSize {
+			for _, v := range vertices {
+				p.Cell[v] = int32(p.NumCells)
+			}
+			p.NumCells++
+			done += len(vertices)
+			if progress != nil {
+				progress(done, n)
+			}
+			return
+		}
+		nextID++
+		id := nextID
+		for _, v := range vertices {
+			member[v] = id
+		}
+		sides := make([][]int, len(inertialFlowLines))
+		cuts := make([]int, len(inertialFlowLines))
+		sources := maxInt(int(inertialFlowBalance*float64(len(vertices))), 1)
+		parallelFor(len(inertialFlowLines), workers, nil, func(i int) {
+			line := inertialFlowLines[i]
+			sorted := append([]int(nil), vertices...)
+			sort.SliceStable(sorted, func(a, b int) bool {
+				u, v := graph.Nodes[sorted[a]], graph.Nodes[sorted[b]]
+				return line[0]*u.Lat+line[1]*u.Long < line[0]*v.Lat+line[1]*v.Long
+			})
+			sides[i], cuts[i] = scratch[i].minCut(graph, ua, sorted, sources, member, id)
+		})
+		// Fewest arcs cut, then most balanced
+		imbalance := func(i int) int { return abs(2*len(sides[i]) - len(vertices)) }
+		best := 0
+		for i := range cuts {
+			if cuts[i] < cuts[best] || cuts[i] == cuts[best] && imbalance(i) < imbalance(best) {
+				best = i
+			}
+		}
+		nextID++
+		for _, v := range sides[best] {
+			member[v] = nextID
+		}
+		left, right := sides[best], make([]int, 0, len(vertices)-len(sides[best]))
+		for _, v := range vertices {
+			if member[v] != nextID {
+				right = append(right, v)
+			}
+		}
+		split(left)
+		split(right)
+	}
+	all := make([]int, n)
+	for i := range all {
+		all[i] = i
+	}
+	split(all)
+	return p
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// Returns the arcs whose ends are in different cells
+func (p *Partition) CutArcs(graph *Graph) []int {
+	arcs := make([]int, 0)
+	for u := range graph.Nodes {
+		heads, _ := graph.Arcs(u)
+		first := int(graph.FirstArc[u])
+		for i, v := range heads {
+			if p.Cell[v] != p.Cell[u] {
+				arcs = append(arcs, first+i)
+			}
+		}
+	}
+	return arcs
+}
+
+// Partitioning methods by name, taking the number of cells wanted. Inertial
+// flow aims for cells of n/cells vertices, so it can make up to about twice
+// as many cells.
+var Partitioners = map[string]func(graph *Graph, cells, workers int) *Partition{
+	"coordinates": func(graph *Graph, cells, workers int) *Partition {
+		return CoordinatePartition(graph, cells)
+	},
+	"inertial": func(graph *Graph, cells, workers int) *Partition {
+		cells = maxInt(cells, 1)
+		return InertialFlowPartition(graph, (len(graph.Nodes)+cells-1)/cells, workers, nil)
+	},
+}
+
+// Writes the cell of every vertex as lines "v <vertex> <cell>" with DIMACS
+// vertex ids after a line "p cells <vertices> <cells>"
+func (p *Partition) Write(out io.Writer, graph *Graph) error {
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, "p cells %d %d\n", len(graph.Nodes), p.NumCells)
+	for id := 0; id < len(graph.Nodes); id++ {
+		fmt.Fprintf(w, "v %d %d\n", id+1, p.Cell[graph.Vertex(id)])
+	}
+	return w.Flush()
+}
+
+// Writes the arcs between cells in the DIMACS arc file format
+func (p *Partition) WriteCutArcs(out io.Writer, graph *Graph) error {
+	arcs := p.CutArcs(graph)
+	tails := make([]int, len(arcs))
+	for i, u := 0, 0; i < len(arcs); i++ {
+		for int(graph.FirstArc[u+1]) <= arcs[i] {
+			u++
+		}
+		tails[i] = u
+	}
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, "p sp %d %d\n", len(graph.Nodes), len(arcs))
+	for i, a := range arcs {
+		fmt.Fprintf(w, "a %d %d %d\n", graph.OriginalID(tails[i])+1, graph.OriginalID(int(graph.Heads[a]))+1, graph.Weights[a])
+	}
+	return w.Flush()
+}
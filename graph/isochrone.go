@@ -0,0 +1,275 @@
+package graph
+
+import (
+	"math"
+)
+
+// Returns every vertex within budget of src in the order they were settled
+// and their distances from src
+func WithinDistance(graph *Graph, src, budget int) ([]int, []int) {
+	state, vertices := searchWithin(graph, src, budget)
+	distances := make([]int, len(vertices))
+	for i, v := range vertices {
+		distances[i] = state.Nodes[v].Distance
+	}
+	return vertices, distances
+}
+
+// Runs Dijkstra from src until the next vertex is farther than budget.
+// Returns the search state and the settled vertices in order.
+func searchWithin(graph *Graph, src, budget int) (*SearchState, []int) {
+	state := NewSearchState(len(graph.Nodes))
+	vertices := make([]int, 0)
+
+	state.Relax(-1, src, 0)
+	for state.Len() != 0 {
+		u := Pop(state)
+		if state.Nodes[u].Distance > budget {
+			break
+		}
+		state.Nodes[u].Processed = true
+		vertices = append(vertices, u)
+		heads, weights := graph.Arcs(u)
+		for i, head := range heads {
+			v := int(head)
+			if !state.Nodes[v].Processed && weights[i] != ArcClosed {
+				state.Relax(u, v, state.Nodes[u].Distance+int(weights[i]))
+			}
+		}
+	}
+	return state, vertices
+}
+
+// Closed ring of cordinates (the first point is repeated at the end).
+// Outer rings run counterclockwise and holes clockwise.
+type Ring []Cord
+
+// Outer ring followed by any holes
+type Polygon []Ring
+
+// Twice the signed area, positive for counterclockwise rings
+func (r Ring) doubleArea() int64 {
+	var area int64
+	for i := 1; i < len(r); i++ {
+		area += int64(r[i-1].Long)*int64(r[i].Lat) - int64(r[i].Long)*int64(r[i-1].Lat)
+	}
+	return area
+}
+
+// Even-odd test for whether c is inside the ring
+func (r Ring) Contains(c Cord) bool {
+	inside := false
+	for i := 1; i < len(r); i++ {
+		a, b := r[i-1], r[i]
+		if (a.Lat > c.Lat) != (b.Lat > c.Lat) {
+			// Longitude where the edge crosses the latitude of c
+			x := float64(a.Long) + float64(c.Lat-a.Lat)*float64(b.Long-a.Long)/float64(b.Lat-a.Lat)
+			if float64(c.Long) < x {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+// Reports whether c is inside the outer ring but not in a hole
+func (p Polygon) Contains(c Cord) bool {
+	if len(p) == 0 || !p[0].Contains(c) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if hole.Contains(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Grid cell containing a cordinate
+type cell struct {
+	x, y int
+}
+
+// Corner of a grid cell. Corner (x, y) is the bottom left corner of cell (x, y).
+type corner struct {
+	x, y int
+}
+
+// Builds polygons covering the area reached by the given vertices.
+//
+// The vertices, and the arcs between them, are rasterized onto a grid with
+// square cells cellSize millionths of a degree wide. Occupied cells are grown
+// by one cell in every direction to close the gaps between roads, and the
+// boundaries between occupied and empty cells are traced into rings.
+func ReachablePolygons(graph *Graph, vertices []int, cellSize int) []Polygon {
+	if len(vertices) == 0 || cellSize <= 0 {
+		return nil
+	}
+	cellOf := func(c Cord) cell {
+		return cell{floorDiv(c.Long, cellSize), floorDiv(c.Lat, cellSize)}
+	}
+	reached := make(map[int]bool, len(vertices))
+	for _, v := range vertices {
+		reached[v] = true
+	}
+	roads := make(map[cell]bool)
+	for _, u := range vertices {
+		roads[cellOf(graph.Nodes[u])] = true
+		heads, _ := graph.Arcs(u)
+		for _, v := range heads {
+			if !reached[int(v)] {
+				continue
+			}
+			// Mark cells along the arc at steps of half a cell
+			a, b := graph.Nodes[u], graph.Nodes[v]
+			length := math.Sqrt(float64(DistanceSquared(a, b)))
+			steps := int(2 * length / float64(cellSize))
+			for i := 1; i < steps; i++ {
+				t := float64(i) / float64(steps)
+				roads[cellOf(Cord{
+					Lat:  a.Lat + int(t*float64(b.Lat-a.Lat)),
+					Long: a.Long + int(t*float64(b.Long-a.Long)),
+				})] = true
+			}
+		}
+	}
+	occupied := make(map[cell]bool, 9*len(roads))
+	for c := range roads {
+		for dx := -1; dx <= 1; dx++ {
+			for dy := -1; dy <= 1; dy++ {
+				occupied[cell{c.x + dx, c.y + dy}] = true
+			}
+		}
+	}
+
+	rings := traceRings(occupied)
+	polygons := make([]Polygon, 0)
+	holes := make([]Ring, 0)
+	for _, corners := range rings {
+		ring := make(Ring, len(corners))
+		for i, p := range corners {
+			ring[i] = Cord{Lat: p.y * cellSize, Long: p.x * cellSize}
+		}
+		if ring.doubleArea() > 0 {
+			polygons = append(polygons, Polygon{ring})
+		} else {
+			holes = append(holes, ring)
+		}
+	}
+	// Rings do not cross, so a hole belongs to the smallest outer ring around
+	// it. Corners can be shared between rings, but edges cannot, so test the
+	// middle of one of the hole's vertical edges.
+	for _, hole := range holes {
+		var inside Cord
+		for i := 1; i < len(hole); i++ {
+			if hole[i-1].Long == hole[i].Long {
+				inside = Cord{Lat: (hole[i-1].Lat + hole[i].Lat) / 2, Long: hole[i].Long}
+				break
+			}
+		}
+		best := -1
+		for i := range polygons {
+			if polygons[i][0].Contains(inside) &&
+				(best == -1 || polygons[i][0].doubleArea() < polygons[best][0].doubleArea()) {
+				best = i
+			}
+		}
+		if best != -1 {
+			polygons[best] = append(polygons[best], hole)
+		}
+	}
+	return polygons
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// Traces the boundaries of the occupied cells into closed rings of corners.
+// Boundary edges are directed so the occupied cell is on the left, which
+// makes outer boundaries counterclockwise and holes clockwise.
+func traceRings(occupied map[cell]bool) [][]corner {
+	edges := make(map[corner][]corner)
+	addEdge := func(from, to corner) {
+		edges[from] = append(edges[from], to)
+	}
+	for c := range occupied {
+		x, y := c.x, c.y
+		if !occupied[cell{x, y - 1}] {
+			addEdge(corner{x, y}, corner{x + 1, y})
+		}
+		if !occupied[cell{x + 1, y}] {
+			addEdge(corner{x + 1, y}, corner{x + 1, y + 1})
+		}
+		if !occupied[cell{x, y + 1}] {
+			addEdge(corner{x + 1, y + 1}, corner{x, y + 1})
+		}
+		if !occupied[cell{x - 1, y}] {
+			addEdge(corner{x, y + 1}, corner{x, y})
+		}
+	}
+
+	rings := make([][]corner, 0)
+	for len(edges) > 0 {
+		// Start from any remaining edge
+		var start corner
+		for start = range edges {
+			break
+		}
+		ring := []corner{start}
+		prev, cur := start, start
+		for {
+			next := nextCorner(edges, prev, cur, len(ring) == 1)
+			ring = append(ring, next)
+			prev, cur = cur, next
+			if cur == start {
+				break
+			}
+		}
+		rings = append(rings, removeCollinear(ring))
+	}
+	return rings
+}
+
+// Removes and returns the edge to follow out of cur after arriving from
+// prev. Where two occupied cells only touch at a corner there are two
+// choices, and taking the left turn keeps each cell's boundary separate.
+func nextCorner(edges map[corner][]corner, prev, cur corner, first bool) corner {
+	options := edges[cur]
+	best := 0
+	if !first && len(options) > 1 {
+		dx, dy := cur.x-prev.x, cur.y-prev.y
+		for i, o := range options {
+			// Positive cross product means a left turn
+			if dx*(o.y-cur.y)-dy*(o.x-cur.x) > 0 {
+				best = i
+			}
+		}
+	}
+	next := options[best]
+	options[best] = options[len(options)-1]
+	if len(options) == 1 {
+		delete(edges, cur)
+	} else {
+		edges[cur] = options[:len(options)-1]
+	}
+	return next
+}
+
+// Drops corners in the middle of straight runs. The ring is closed, so the
+// first and last corners are the same.
+func removeCollinear(ring []corner) []corner {
+	n := len(ring) - 1
+	kept := make([]corner, 0, len(ring))
+	for i := 0; i < n; i++ {
+		prev, cur, next := ring[(i+n-1)%n], ring[i], ring[(i+1)%n]
+		if (cur.x-prev.x)*(next.y-cur.y)-(cur.y-prev.y)*(next.x-cur.x) != 0 {
+			kept = append(kept, cur)
+		}
+	}
+	return append(kept, kept[0])
+}
@@ -0,0 +1,123 @@
+package graph
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Path through the graph from its first to its last vertex
+type Path struct {
+	Vertices []int
+	Distance int
+}
+
+// Key identifying a path by its vertices
+func (p Path) key() string {
+	var b strings.Builder
+	for _, v := range p.Vertices {
+		fmt.Fprintf(&b, "%d,", v)
+	}
+	return b.String()
+}
+
+// Runs a search from src to dest that avoids the banned vertices, arcs
+// between banned pairs of vertices and arcs avoid skips (avoid may be nil),
+// with arc costs from cost if it is not nil. The search runs on state, which
+// is reset afterwards. Returns the path or nil if dest is not reachable.
+func restrictedPath(state *SearchState, graph *Graph, src, dest int, potential PotentialFunc, avoid arcFilter, cost arcCost, bannedVertices []bool, bannedArcs map[[2]int]bool) *Path {
+	visitSeq := state.search(graph, src, dest, potential, func(u, arc, distance int) bool {
+		v := int(graph.Heads[arc])
+		return bannedVertices[v] || bannedArcs[[2]int{u, v}] || avoid != nil && avoid(u, arc, distance)
+	}, cost)
+	defer state.reset(visitSeq)
+	vertices := state.pathTo(dest)
+	if vertices == nil {
+		return nil
+	}
+	return &Path{vertices, state.Nodes[dest].Distance}
+}
+
+// Finds up to k shortest loopless paths from src to dest ordered by length
+// using Yen's algorithm.
+//
+// Each path after the first is found by taking a prefix (the root) of the
+// previous path and searching for the shortest way to finish it (the spur)
+// that avoids the root's other vertices and the next arc of every known path
+// sharing the root. Removing vertices and arcs can only make distances
+// longer, so a feasible potential for the whole graph stays feasible for
+// every spur search. The searches share one search state, so each costs
+// about as much as the vertices it visits. Searches follow opts, and with
+// opts.Cost the paths are the k cheapest and their Distance is their cost.
+func KShortestPaths(graph *Graph, src, dest, k int, opts SearchOptions) []Path {
+	paths := make([]Path, 0, k)
+	if k <= 0 {
+		return paths
+	}
+	potential, avoid, cost := opts.potential(), opts.Avoid.filter(graph, dest), opts.cost()
+	bannedVertices := make([]bool, len(graph.Nodes))
+	state := NewSearchState(len(graph.Nodes))
+	first := restrictedPath(state, graph, src, dest, potential, avoid, cost, bannedVertices, nil)
+	if first == nil {
+		return paths
+	}
+	paths = append(paths, *first)
+	seen := map[string]bool{first.key(): true}
+	candidates := make([]Path, 0)
+
+	for len(paths) < k {
+		prev := paths[len(paths)-1].Vertices
+		rootDistance := 0
+		for i := 0; i+1 < len(prev); i++ {
+			spur := prev[i]
+			root := prev[:i+1]
+			bannedArcs := make(map[[2]int]bool)
+			for _, p := range paths {
+				if len(p.Vertices) > i+1 && equalInts(p.Vertices[:i+1], root) {
+					bannedArcs[[2]int{spur, p.Vertices[i+1]}] = true
+				}
+			}
+			for _, v := range root[:i] {
+				bannedVertices[v] = true
+			}
+			if spurPath := restrictedPath(state, graph, spur, dest, potential, avoid, cost, bannedVertices, bannedArcs); spurPath != nil {
+				vertices := make([]int, 0, i+len(spurPath.Vertices))
+				vertices = append(vertices, root[:i]...)
+				vertices = append(vertices, spurPath.Vertices...)
+				candidate := Path{vertices, rootDistance + spurPath.Distance}
+				if key := candidate.key(); !seen[key] {
+					seen[key] = true
+					candidates = append(candidates, candidate)
+				}
+			}
+			for _, v := range root[:i] {
+				bannedVertices[v] = false
+			}
+			rootDistance += PathCost(graph, prev[i:i+2], opts.Cost)
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		best := 0
+		for i, c := range candidates {
+			if c.Distance < candidates[best].Distance {
+				best = i
+			}
+		}
+		paths = append(paths, candidates[best])
+		candidates[best] = candidates[len(candidates)-1]
+		candidates = candidates[:len(candidates)-1]
+	}
+	return paths
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,187 @@
+package graph
+
+import (
+	"errors"
+	"math"
+)
+
+// Returns the ALT potential for searches towards dest using distances
+// from landmarks stored one slice per landmark
+func LandmarkPotential(landmarkDistances [][]int, dest int) PotentialFunc {
+	return func(v int) int {
+		// max{d(L, t) - dist(L, v) for L in landmarks}
+		maxDist := 0
+		for _, distances := range landmarkDistances {
+			// Unreachable -> dont want to deal with underflow
+			if distances[dest] == math.MaxInt64 || distances[v] == math.MaxInt64 {
+				continue
+			}
+			dist := distances[dest] - distances[v]
+			if dist > maxDist {
+				maxDist = dist
+			}
+		}
+		return maxDist
+	}
+}
+
+// How distances from landmarks are stored
+type LandmarkFormat int
+
+const (
+	// Exact distances, 4 bytes per vertex per landmark
+	LandmarkUint32 LandmarkFormat = iota
+	// Distances in multiples of a per landmark step, 2 bytes per vertex per landmark
+	LandmarkUint16
+)
+
+func (f LandmarkFormat) String() string {
+	switch f {
+	case LandmarkUint32:
+		return "uint32"
+	case LandmarkUint16:
+		return "uint16"
+	}
+	return "unknown"
+}
+
+// Parses the name of a landmark format as returned by String
+func ParseLandmarkFormat(s string) (LandmarkFormat, error) {
+	for _, f := range []LandmarkFormat{LandmarkUint32, LandmarkUint16} {
+		if f.String() == s {
+			return f, nil
+		}
+	}
+	return 0, errors.New("unknown landmark format: " + s)
+}
+
+const (
+	unreachable32 = math.MaxUint32
+	unreachable16 = math.MaxUint16
+)
+
+// Compact table of distances from landmarks to every vertex.
+//
+// Distances are stored vertex major (all landmarks for vertex 0, then all
+// landmarks for vertex 1, ...) so computing a potential reads one contiguous
+// row instead of touching one cache line per landmark.
+//
+// In the uint16 format the distances for landmark L are computed on the graph
+// with every arc weight divided by Steps[L] and rounded down. Let d' be those
+// distances. Then d'(L, v) <= d'(L, u) + floor(w(u, v)/step) for every arc, so
+// pi(v) = step*(d'(L, t) - d'(L, v)) satisfies
+// pi(u) - pi(v) <= step*floor(w(u, v)/step) <= w(u, v),
+// which means the potential stays feasible (and a lower bound) despite the
+// rounding. Rounding each vertex's exact distance instead would make the
+// reduced cost of some arcs negative.
+type LandmarkDistances struct {
+	Landmarks []int
+	Format    LandmarkFormat
+	// Rounding step for each landmark (all 1 in the uint32 format)
+	Steps []int
+	// Only one of these is used depending on the format
+	exact     []uint32
+	quantized []uint16
+}
+
+// Computes distances from landmarks running up to workers searches at once
+func NewLandmarkDistances(graph *Graph, landmarks []int, format LandmarkFormat, workers int, progress ProgressFunc) (*LandmarkDistances, error) {
+	n, k := len(graph.Nodes), len(landmarks)
+	ld := &LandmarkDistances{
+		Landmarks: landmarks,
+		Format:    format,
+		Steps:     make([]int, k),
+	}
+	switch format {
+	case LandmarkUint32:
+		ld.exact = make([]uint32, n*k)
+	case LandmarkUint16:
+		ld.quantized = make([]uint16, n*k)
+	default:
+		return nil, errors.New("unknown landmark format")
+	}
+
+	errs := make([]error, k)
+	parallelFor(k, workers, progress, func(i int) {
+		distances := Dijkstra(graph, landmarks[i])
+		maxDist := 0
+		for _, d := range distances {
+			if d != math.MaxInt64 && d > maxDist {
+				maxDist = d
+			}
+		}
+		if format == LandmarkUint32 {
+			if maxDist >= unreachable32 {
+				errs[i] = errors.New("landmark distance does not fit in 32 bits")
+				return
+			}
+			ld.Steps[i] = 1
+			for v, d := range distances {
+				if d == math.MaxInt64 {
+					ld.exact[v*k+i] = unreachable32
+				} else {
+					ld.exact[v*k+i] = uint32(d)
+				}
+			}
+			return
+		}
+		// Rounded distances are at most the exact distance over the step, so
+		// this step keeps every reachable vertex below the unreachable marker.
+		// The exact search is only needed to find it.
+		step := maxDist/(unreachable16-1) + 1
+		ld.Steps[i] = step
+		for v, d := range dijkstra(graph, landmarks[i], step) {
+			if d == math.MaxInt64 {
+				ld.quantized[v*k+i] = unreachable16
+			} else {
+				ld.quantized[v*k+i] = uint16(d)
+			}
+		}
+	})
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ld, nil
+}
+
+// Number of bytes used to store the distances
+func (ld *LandmarkDistances) Bytes() int {
+	return 4*len(ld.exact) + 2*len(ld.quantized)
+}
+
+// Returns the ALT potential for searches towards dest
+func (ld *LandmarkDistances) Potential(dest int) PotentialFunc {
+	k := len(ld.Landmarks)
+	if ld.Format == LandmarkUint16 {
+		target := ld.quantized[dest*k : (dest+1)*k]
+		return func(v int) int {
+			maxDist := 0
+			for i, d := range ld.quantized[v*k : (v+1)*k] {
+				if target[i] == unreachable16 || d == unreachable16 {
+					continue
+				}
+				dist := (int(target[i]) - int(d)) * ld.Steps[i]
+				if dist > maxDist {
+					maxDist = dist
+				}
+			}
+			return maxDist
+		}
+	}
+	target := ld.exact[dest*k : (dest+1)*k]
+	return func(v int) int {
+		maxDist := 0
+		for i, d := range ld.exact[v*k : (v+1)*k] {
+			if target[i] == unreachable32 || d == unreachable32 {
+				continue
+			}
+			dist := int(target[i]) - int(d)
+			if dist > maxDist {
+				maxDist = dist
+			}
+		}
+		return maxDist
+	}
+}
@@ -0,0 +1,55 @@
+package graph
+
+import (
+	"math"
+)
+
+// Computes distances from src to each target (math.MaxInt64 if unreachable).
+// Runs Dijkstra from src and stops as soon as every target is settled, so
+// the search only covers the ball around src reaching the farthest target.
+func OneToMany(graph *Graph, src int, targets []int) []int {
+	state := NewSearchState(len(graph.Nodes))
+	isTarget := make(map[int]bool, len(targets))
+	for _, t := range targets {
+		isTarget[t] = true
+	}
+	remaining := len(isTarget)
+
+	state.Relax(-1, src, 0)
+	for state.Len() != 0 && remaining > 0 {
+		u := Pop(state)
+		state.Nodes[u].Processed = true
+		if isTarget[u] {
+			remaining--
+		}
+		heads, weights := graph.Arcs(u)
+		for i, head := range heads {
+			v := int(head)
+			if !state.Nodes[v].Processed && weights[i] != ArcClosed {
+				state.Relax(u, v, state.Nodes[u].Distance+int(weights[i]))
+			}
+		}
+	}
+
+	distances := make([]int, len(targets))
+	for i, t := range targets {
+		if state.Nodes[t].Processed {
+			distances[i] = state.Nodes[t].Distance
+		} else {
+			distances[i] = math.MaxInt64
+		}
+	}
+	return distances
+}
+
+// Computes the distance from every source to every target, where entry [i][j]
+// is the distance from sources[i] to targets[j] (math.MaxInt64 if unreachable).
+// Runs one pruned search per source on up to workers goroutines (workers <= 0
+// uses all CPUs).
+func DistanceMatrix(graph *Graph, sources, targets []int, workers int) [][]int {
+	matrix := make([][]int, len(sources))
+	parallelFor(len(sources), workers, nil, func(i int) {
+		matrix[i] = OneToMany(graph, sources[i], targets)
+	})
+	return matrix
+}
@@ -0,0 +1,370 @@
+package graph
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"sync"
+)
+
+// Customizable route planning: the metric independent part of the
+// preprocessing builds, for every cell of a multilevel partition, a clique
+// from the cell's entry vertices to its exit vertices. Customizing a metric
+// only computes the clique arc weights, bottom up from the cells of the
+// finest level, so it can be repeated whenever arc weights change.
+// Queries run Dijkstra on the graph near the source and target and on the
+// cliques of ever coarser cells in between.
+type Overlay struct {
+	graph  *Graph
+	levels []overlayLevel
+}
+
+// Entry and exit vertices of the cells of one level
+type overlayLevel struct {
+	cell []int32
+	// Position of each vertex among its cell's entries (heads of arcs from
+	// other cells) and exits (tails of arcs to other cells), -1 if it is not
+	// one
+	entryIndex []int32
+	exitIndex  []int32
+	entries    [][]int32
+	exits      [][]int32
+	// Offset of each cell's clique, entries x exits row major, in the
+	// clique weights of the level
+	cliqueFirst []int
+}
+
+// Arc weights and the clique weights computed from them
+type CustomizedMetric struct {
+	overlay *Overlay
+	weights []uint32
+	// Clique weights of each level, unreachable32 where the exit cannot be
+	// reached from the entry inside the cell
+	cliques [][]uint32
+	scratch sync.Pool
+}
+
+// Finds the entry and exit vertices of every cell of partition. This does
+// not depend on arc weights.
+func NewOverlay(graph *Graph, partition *MultilevelPartition) *Overlay {
+	n := len(graph.Nodes)
+	o := &Overlay{graph: graph, levels: make([]overlayLevel, len(partition.Levels))}
+	for l, p := range partition.Levels {
+		level := overlayLevel{
+			cell:        p.Cell,
+			entryIndex:  make([]int32, n),
+			exitIndex:   make([]int32, n),
+			entries:     make([][]int32, p.NumCells),
+			exits:       make([][]int32, p.NumCells),
+			cliqueFirst: make([]int, p.NumCells+1),
+		}
+		for v := 0; v < n; v++ {
+			level.entryIndex[v], level.exitIndex[v] = -1, -1
+		}
+		for u := 0; u < n; u++ {
+			heads, _ := graph.Arcs(u)
+			for _, v := range heads {
+				if p.Cell[v] == p.Cell[u] {
+					continue
+				}
+				if level.exitIndex[u] == -1 {
+					level.exitIndex[u] = int32(len(level.exits[p.Cell[u]]))
+					level.exits[p.Cell[u]] = append(level.exits[p.Cell[u]], int32(u))
+				}
+				if level.entryIndex[v] == -1 {
+					level.entryIndex[v] = int32(len(level.entries[p.Cell[v]]))
+					level.entries[p.Cell[v]] = append(level.entries[p.Cell[v]], v)
+				}
+			}
+		}
+		for c := 0; c < p.NumCells; c++ {
+			level.cliqueFirst[c+1] = level.cliqueFirst[c] + len(level.entries[c])*len(level.exits[c])
+		}
+		o.levels[l] = level
+	}
+	return o
+}
+
+// Number of clique arcs over all levels
+func (o *Overlay) CliqueArcs() int {
+	total := 0
+	for _, level := range o.levels {
+		total += level.cliqueFirst[len(level.cliqueFirst)-1]
+	}
+	return total
+}
+
+// Per search state, reset after each search by undoing only the vertices
+// touched
+type overlayScratch struct {
+	dist   []int
+	parent []int32
+	// Level of the clique arc that reached each vertex, -1 for an arc of the
+	// graph
+	via     []int8
+	touched []int32
+	queue   reachQueue
+}
+
+func newOverlayScratch(n int) *overlayScratch {
+	sc := &overlayScratch{
+		dist:   make([]int, n),
+		parent: make([]int32, n),
+		via:    make([]int8, n),
+	}
+	for i := range sc.dist {
+		sc.dist[i] = math.MaxInt64
+	}
+	return sc
+}
+
+func (sc *overlayScratch) relax(from, v int32, d int, via int8) {
+	if d >= sc.dist[v] {
+		return
+	}
+	if sc.dist[v] == math.MaxInt64 {
+		sc.touched = append(sc.touched, v)
+	}
+	sc.dist[v], sc.parent[v], sc.via[v] = d, from, via
+	heap.Push(&sc.queue, reachEntry{d, 0, v})
+}
+
+// Pops the closest vertex not popped before, or returns -1 if there are none
+func (sc *overlayScratch) pop() int32 {
+	for sc.queue.Len() > 0 {
+		e := heap.Pop(&sc.queue).(reachEntry)
+		if e.dist == sc.dist[e.vertex] {
+			return e.vertex
+		}
+	}
+	return -1
+}
+
+func (sc *overlayScratch) reset() {
+	for _, v := range sc.touched {
+		sc.dist[v] = math.MaxInt64
+	}
+	sc.touched, sc.queue = sc.touched[:0], sc.queue[:0]
+}
+
+// Computes clique weights for the given arc weights (one per arc of the
+// graph, ArcClosed for arcs that cannot be used) using up to workers
+// goroutines (workers <= 0 uses all CPUs). Levels are customized from finest
+// to coarsest. A cell of the finest level runs Dijkstra inside the cell from
+// each entry vertex; a coarser cell runs it on the cliques of its subcells
+// and the arcs between them. The overlay is not changed, so metrics can be
+// customized while queries run on other metrics.
+func (o *Overlay) Customize(weights []uint32, workers int) (*CustomizedMetric, error) {
+	if len(weights) != len(o.graph.Heads) {
+		return nil, errors.New("need one weight per arc")
+	}
+	n := len(o.graph.Nodes)
+	m := &CustomizedMetric{
+		overlay: o,
+		weights: weights,
+		cliques: make([][]uint32, len(o.levels)),
+	}
+	m.scratch.New = func() interface{} { return newOverlayScratch(n) }
+	for l := range o.levels {
+		level := &o.levels[l]
+		m.cliques[l] = make([]uint32, level.cliqueFirst[len(level.cliqueFirst)-1])
+		errs := make([]error, len(level.entries))
+		parallelFor(len(level.entries), workers, nil, func(c int) {
+			sc := m.scratch.Get().(*overlayScratch)
+			errs[c] = m.customizeCell(sc, l, c)
+			m.scratch.Put(sc)
+		})
+		for _, err := range errs {
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// Fills in the clique of cell c of level l
+func (m *CustomizedMetric) customizeCell(sc *overlayScratch, l, c int) error {
+	level := &m.overlay.levels[l]
+	exits := level.exits[c]
+	for i, e := range level.entries[c] {
+		sc.relax(-1, e, 0, -1)
+		m.searchCell(sc, l, c, -1)
+		row := m.cliques[l][level.cliqueFirst[c]+i*len(exits) : level.cliqueFirst[c]+(i+1)*len(exits)]
+		for j, x := range exits {
+			switch d := sc.dist[x]; {
+			case d == math.MaxInt64:
+				row[j] = unreachable32
+			case d >= unreachable32:
+				sc.reset()
+				return errors.New("clique distance does not fit in 32 bits")
+			default:
+				row[j] = uint32(d)
+			}
+		}
+		sc.reset()
+	}
+	return nil
+}
+
+// Runs Dijkstra from the vertices queued in sc without leaving cell c of
+// level l until target (-1 for none) is popped. A cell of the finest level
+// follows its arcs, a coarser one the cliques of its subcells and the arcs
+// between them.
+func (m *CustomizedMetric) searchCell(sc *overlayScratch, l, c int, target int32) {
+	level := &m.overlay.levels[l]
+	for u := sc.pop(); u != -1 && u != target; u = sc.pop() {
+		if l == 0 {
+			m.relaxArcs(sc, u, func(v int32) bool { return level.cell[v] == int32(c) })
+			continue
+		}
+		sub := &m.overlay.levels[l-1]
+		if sub.entryIndex[u] >= 0 {
+			m.relaxClique(sc, l-1, u)
+		}
+		if sub.exitIndex[u] >= 0 {
+			m.relaxArcs(sc, u, func(v int32) bool { return level.cell[v] == int32(c) && sub.cell[v] != sub.cell[u] })
+		}
+	}
+}
+
+// Relaxes the open arcs from u to vertices for which follow returns true
+func (m *CustomizedMetric) relaxArcs(sc *overlayScratch, u int32, follow func(v int32) bool) {
+	g := m.overlay.graph
+	for a := g.FirstArc[u]; a < g.FirstArc[u+1]; a++ {
+		v := g.Heads[a]
+		if m.weights[a] != ArcClosed && follow(v) {
+			sc.relax(u, v, sc.dist[u]+int(m.weights[a]), -1)
+		}
+	}
+}
+
+// Relaxes the clique arcs of level l from entry vertex u to the exits of
+// its cell
+func (m *CustomizedMetric) relaxClique(sc *overlayScratch, l int, u int32) {
+	level := &m.overlay.levels[l]
+	c := level.cell[u]
+	exits := level.exits[c]
+	first := level.cliqueFirst[c] + int(level.entryIndex[u])*len(exits)
+	for j, x := range exits {
+		if w := m.cliques[l][first+j]; w != unreachable32 {
+			sc.relax(u, x, sc.dist[u]+int(w), int8(l))
+		}
+	}
+}
+
+// Number of bytes used by the clique weights
+func (m *CustomizedMetric) Bytes() int {
+	total := 0
+	for _, clique := range m.cliques {
+		total += 4 * len(clique)
+	}
+	return total
+}
+
+// Runs Dijkstra from src to dest on the overlay. A vertex in the same
+// finest cell as src or dest follows its arcs. Any other vertex is in a
+// different cell than both at some level, and at the coarsest such level it
+// follows the clique arcs of its cell and the arcs leaving the cell, since
+// the shortest path has to leave the cell before reaching dest. Clique arcs
+// on the path found are unpacked level by level through the cliques of the
+// subcells of their cell. Returns
+// the reverse of the shortest path and the vertices visited like
+// SearchSequence.
+func (m *CustomizedMetric) SearchSequence(src, dest int) ([]int, []int) {
+	o := m.overlay
+	// Highest level at which v is in neither src's nor dest's cell, -1 if
+	// there is none
+	queryLevel := func(v int32) int {
+		for l := len(o.levels) - 1; l >= 0; l-- {
+			cell := o.levels[l].cell
+			if cell[v] != cell[src] && cell[v] != cell[dest] {
+				return l
+			}
+		}
+		return -1
+	}
+
+	sc := m.scratch.Get().(*overlayScratch)
+	defer m.scratch.Put(sc)
+	defer sc.reset()
+	visitSeq := make([]int, 0)
+	sc.relax(-1, int32(src), 0, -1)
+	for u := sc.pop(); u != -1; u = sc.pop() {
+		visitSeq = append(visitSeq, int(u))
+		if int(u) == dest {
+			break
+		}
+		l := queryLevel(u)
+		if l == -1 {
+			m.relaxArcs(sc, u, func(int32) bool { return true })
+			continue
+		}
+		level := &o.levels[l]
+		if level.entryIndex[u] >= 0 {
+			m.relaxClique(sc, l, u)
+		}
+		if level.exitIndex[u] >= 0 {
+			m.relaxArcs(sc, u, func(v int32) bool { return level.cell[v] != level.cell[u] })
+		}
+	}
+	if sc.dist[dest] == math.MaxInt64 || src == dest {
+		return make([]int, 0), visitSeq
+	}
+
+	// Overlay path from dest back to src with each clique arc replaced by
+	// its path inside the cell
+	inner := m.expand(sc.hops(int32(dest)))
+	path := make([]int, len(inner))
+	for i, v := range inner {
+		path[len(inner)-1-i] = int(v)
+	}
+	return path, visitSeq
+}
+
+// Vertex of an overlay path and the level of the clique arc reaching it, -1
+// for an arc of the graph
+type overlayHop struct {
+	vertex int32
+	via    int8
+}
+
+// Returns the overlay path to v found by the search from src to v
+func (sc *overlayScratch) hops(v int32) []overlayHop {
+	hops := make([]overlayHop, 0)
+	for ; v != -1; v = sc.parent[v] {
+		hops = append(hops, overlayHop{v, sc.via[v]})
+	}
+	for i, j := 0, len(hops)-1; i < j; i, j = i+1, j-1 {
+		hops[i], hops[j] = hops[j], hops[i]
+	}
+	return hops
+}
+
+// Returns the vertices of an overlay path with every clique arc unpacked
+func (m *CustomizedMetric) expand(hops []overlayHop) []int32 {
+	path := make([]int32, 0, len(hops))
+	for i, h := range hops {
+		if h.via == -1 || i == 0 {
+			path = append(path, h.vertex)
+			continue
+		}
+		// Without the clique's entry, the previous hop
+		path = append(path, m.unpack(int(h.via), hops[i-1].vertex, h.vertex)[1:]...)
+	}
+	return path
+}
+
+// Returns the shortest path from entry to exit of the same cell of level l
+// inside the cell. Above the finest level the path is found on the cliques
+// of the subcells, which are unpacked in turn, so each level only searches
+// the overlay of one cell.
+func (m *CustomizedMetric) unpack(l int, entry, exit int32) []int32 {
+	sc := m.scratch.Get().(*overlayScratch)
+	sc.relax(-1, entry, 0, -1)
+	m.searchCell(sc, l, int(m.overlay.levels[l].cell[entry]), exit)
+	hops := sc.hops(exit)
+	sc.reset()
+	m.scratch.Put(sc)
+	return m.expand(hops)
+}
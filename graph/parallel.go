@@ -0,0 +1,119 @@
+package graph
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Called as preprocessing makes progress with the number of completed units
+// of work out of the total. Calls are serialized, so the function does not
+// need to be safe for concurrent use.
+type ProgressFunc func(done, total int)
+
+// Number of goroutines to use when the caller asks for workers <= 0
+func defaultWorkers(workers int) int {
+	if workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return workers
+}
+
+// Runs work(i) for every i in [0, n) using up to workers goroutines.
+// Each work item must be independent of the others.
+func parallelFor(n, workers int, progress ProgressFunc, work func(i int)) {
+	workers = defaultWorkers(workers)
+	if workers > n {
+		workers = n
+	}
+	var next int64 = -1
+	var mu sync.Mutex
+	done := 0
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				work(i)
+				if progress != nil {
+					mu.Lock()
+					done++
+					progress(done, n)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Computes distance from each landmark to every vertex running one Dijkstra
+// per landmark on up to workers goroutines (workers <= 0 uses all CPUs)
+func ParallelDistancesFromLandmarks(graph *Graph, landmarks []int, workers int, progress ProgressFunc) [][]int {
+	distances := make([][]int, len(landmarks))
+	parallelFor(len(landmarks), workers, progress, func(i int) {
+		distances[i] = Dijkstra(graph, landmarks[i])
+	})
+	return distances
+}
+
+// Frontiers smaller than this are expanded by a single goroutine since the
+// synchronization costs more than it saves
+const minParallelFrontier = 1024
+
+// Level synchronous breadth first search. Each level of the frontier is split
+// between workers which claim undiscovered vertices with compare and swap.
+func parallelBFS(graph *Graph, src, workers int) []int {
+	workers = defaultWorkers(workers)
+	if workers == 1 {
+		return bfs(graph, src)
+	}
+	hops := make([]int64, len(graph.Nodes))
+	for i := range hops {
+		hops[i] = math.MaxInt64
+	}
+	hops[src] = 0
+	frontier := []int{src}
+	for level := int64(1); len(frontier) > 0; level++ {
+		chunks := workers
+		if len(frontier) < minParallelFrontier {
+			chunks = 1
+		}
+		next := make([][]int, chunks)
+		var wg sync.WaitGroup
+		for c := 0; c < chunks; c++ {
+			wg.Add(1)
+			go func(c int) {
+				defer wg.Done()
+				lo := c * len(frontier) / chunks
+				hi := (c + 1) * len(frontier) / chunks
+				for _, u := range frontier[lo:hi] {
+					heads, _ := graph.Arcs(u)
+					for _, head := range heads {
+						v := int(head)
+						if atomic.LoadInt64(&hops[v]) == math.MaxInt64 &&
+							atomic.CompareAndSwapInt64(&hops[v], math.MaxInt64, level) {
+							next[c] = append(next[c], v)
+						}
+					}
+				}
+			}(c)
+		}
+		wg.Wait()
+		frontier = frontier[:0]
+		for _, part := range next {
+			frontier = append(frontier, part...)
+		}
+	}
+	distances := make([]int, len(hops))
+	for i, h := range hops {
+		distances[i] = int(h)
+	}
+	return distances
+}
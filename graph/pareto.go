@@ -0,0 +1,115 @@
+package graph
+
+import (
+	"container/heap"
+	"errors"
+)
+
+// Route that is not beaten on both costs by any other route
+type ParetoPath struct {
+	// Vertices and cost in the graph's Weights
+	Path
+	// Cost in the graph's SecondWeights
+	SecondCost int
+}
+
+// Partial route to a vertex in a multi-criteria search
+type label struct {
+	costs  [2]int
+	vertex int32
+	// Index of the label this one was extended from, -1 at the source
+	pred int32
+}
+
+// Indices into a slice of labels ordered lexicographically by costs
+type labelHeap struct {
+	labels  *[]label
+	indices []int32
+}
+
+func (h *labelHeap) Len() int { return len(h.indices) }
+
+func (h *labelHeap) Less(i, j int) bool {
+	a, b := (*h.labels)[h.indices[i]].costs, (*h.labels)[h.indices[j]].costs
+	return a[0] < b[0] || a[0] == b[0] && a[1] < b[1]
+}
+
+func (h *labelHeap) Swap(i, j int) { h.indices[i], h.indices[j] = h.indices[j], h.indices[i] }
+
+func (h *labelHeap) Push(x interface{}) { h.indices = append(h.indices, x.(int32)) }
+
+func (h *labelHeap) Pop() interface{} {
+	last := h.indices[len(h.indices)-1]
+	h.indices = h.indices[:len(h.indices)-1]
+	return last
+}
+
+// Finds the Pareto front of routes from src to dest over the graph's Weights
+// and SecondWeights, ordered by increasing first cost (and so decreasing
+// second cost). Routes with equal costs are only returned once.
+//
+// Uses Martins' label setting algorithm: labels are settled in lexicographic
+// order of their costs, so a label is dominated exactly when the last label
+// settled at its vertex has a second cost that is no larger. Labels
+// dominated at their vertex or by a route already found to dest are dropped.
+// The front can be exponentially large, so at most maxLabels labels are
+// settled per vertex (0 for no limit); with a limit the result may miss
+// some Pareto optimal routes but every route returned is still optimal
+// among those found.
+func ParetoPaths(graph *Graph, src, dest, maxLabels int) ([]ParetoPath, error) {
+	if graph.SecondWeights == nil {
+		return nil, errors.New("graph has no second costs")
+	}
+	labels := []label{{vertex: int32(src), pred: -1}}
+	queue := &labelHeap{labels: &labels, indices: []int32{0}}
+	// Labels settled at each vertex in order
+	settled := make([][]int32, len(graph.Nodes))
+	dominated := func(v int, costs [2]int) bool {
+		if s := settled[v]; len(s) > 0 && labels[s[len(s)-1]].costs[1] <= costs[1] {
+			return true
+		}
+		if s := settled[dest]; len(s) > 0 && labels[s[len(s)-1]].costs[1] <= costs[1] {
+			return true
+		}
+		return maxLabels > 0 && len(settled[v]) >= maxLabels
+	}
+
+	for queue.Len() > 0 {
+		i := heap.Pop(queue).(int32)
+		l := labels[i]
+		u := int(l.vertex)
+		if dominated(u, l.costs) {
+			continue
+		}
+		settled[u] = append(settled[u], i)
+		if u == dest {
+			continue
+		}
+		for a := int(graph.FirstArc[u]); a < int(graph.FirstArc[u+1]); a++ {
+			if graph.Weights[a] == ArcClosed {
+				continue
+			}
+			v := int(graph.Heads[a])
+			costs := [2]int{l.costs[0] + int(graph.Weights[a]), l.costs[1] + int(graph.SecondWeights[a])}
+			if dominated(v, costs) {
+				continue
+			}
+			labels = append(labels, label{costs, int32(v), i})
+			heap.Push(queue, int32(len(labels)-1))
+		}
+	}
+
+	paths := make([]ParetoPath, 0, len(settled[dest]))
+	for _, i := range settled[dest] {
+		vertices := make([]int, 0)
+		for j := i; j != -1; j = labels[j].pred {
+			vertices = append(vertices, int(labels[j].vertex))
+		}
+		for a, b := 0, len(vertices)-1; a < b; a, b = a+1, b-1 {
+			vertices[a], vertices[b] = vertices[b], vertices[a]
+		}
+		costs := labels[i].costs
+		paths = append(paths, ParetoPath{Path{vertices, costs[0]}, costs[1]})
+	}
+	return paths, nil
+}
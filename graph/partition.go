@@ -0,0 +1,167 @@
+package graph
+
+import (
+	"math"
+	"sort"
+)
+
+// Assignment of every vertex to one of NumCells cells
+type Partition struct {
+	Cell     []int32
+	NumCells int
+}
+
+// Vertices of each cell that can be entered from another cell
+func (p *Partition) boundaryVertices(graph *Graph) [][]int {
+	boundary := make([]bool, len(graph.Nodes))
+	for u := range graph.Nodes {
+		heads, _ := graph.Arcs(u)
+		for _, v := range heads {
+			if p.Cell[v] != p.Cell[u] {
+				boundary[v] = true
+			}
+		}
+	}
+	vertices := make([][]int, p.NumCells)
+	for v, b := range boundary {
+		if b {
+			vertices[p.Cell[v]] = append(vertices[p.Cell[v]], v)
+		}
+	}
+	return vertices
+}
+
+// Returns a small set of vertices containing an endpoint of every arc
+// between two cells, so every path from one cell to another passes through
+// one of them. Vertices are picked greedily by how many of the remaining
+// arcs between cells they cover.
+func (p *Partition) CutVertices(graph *Graph) []int {
+	n := len(graph.Nodes)
+	// Arcs between cells as pairs of endpoints, and how many touch each
+	// vertex
+	cut := make([][2]int32, 0)
+	count := make([]int, n)
+	for u := 0; u < n; u++ {
+		heads, _ := graph.Arcs(u)
+		for _, v := range heads {
+			if p.Cell[v] != p.Cell[u] {
+				cut = append(cut, [2]int32{int32(u), v})
+				count[u]++
+				count[v]++
+			}
+		}
+	}
+	incident := make([][]int32, n)
+	for i, arc := range cut {
+		incident[arc[0]] = append(incident[arc[0]], int32(i))
+		incident[arc[1]] = append(incident[arc[1]], int32(i))
+	}
+	candidates := make([]int, 0)
+	for v, c := range count {
+		if c > 0 {
+			candidates = append(candidates, v)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return count[candidates[i]] > count[candidates[j]]
+	})
+	covered := make([]bool, len(cut))
+	vertices := make([]int, 0)
+	for _, v := range candidates {
+		picked := false
+		for _, i := range incident[v] {
+			if !covered[i] {
+				covered[i], picked = true, true
+			}
+		}
+		if picked {
+			vertices = append(vertices, v)
+		}
+	}
+	return vertices
+}
+
+// Splits the vertices into cells of nearly equal size by coordinates,
+// recursively cutting the vertex set at the median of whichever of latitude
+// and longitude has the larger extent (a k-d tree).
+func CoordinatePartition(graph *Graph, cells int) *Partition {
+	cells = maxInt(minInt(cells, len(graph.Nodes)), 1)
+	p := &Partition{Cell: make([]int32, len(graph.Nodes)), NumCells: cells}
+	vertices := make([]int, len(graph.Nodes))
+	for i := range vertices {
+		vertices[i] = i
+	}
+	for c, part := range coordinateSplit(graph, vertices, cells) {
+		for _, v := range part {
+			p.Cell[v] = int32(c)
+		}
+	}
+	return p
+}
+
+// Splits vertices (reordering them) into cells parts of nearly equal size
+// with a k-d tree
+func coordinateSplit(graph *Graph, vertices []int, cells int) [][]int {
+	parts := make([][]int, 0, cells)
+	var split func(vertices []int, cells int)
+	split = func(vertices []int, cells int) {
+		if cells == 1 {
+			parts = append(parts, vertices)
+			return
+		}
+		minLat, maxLat, minLong, maxLong := math.MaxInt32, -math.MaxInt32, math.MaxInt32, -math.MaxInt32
+		for _, v := range vertices {
+			c := graph.Nodes[v]
+			minLat, maxLat = minInt(minLat, c.Lat), maxInt(maxLat, c.Lat)
+			minLong, maxLong = minInt(minLong, c.Long), maxInt(maxLong, c.Long)
+		}
+		byLat := maxLat-minLat > maxLong-minLong
+		sort.Slice(vertices, func(i, j int) bool {
+			a, b := graph.Nodes[vertices[i]], graph.Nodes[vertices[j]]
+			if byLat {
+				return a.Lat < b.Lat
+			}
+			return a.Long < b.Long
+		})
+		// Cells on each side in proportion to the vertices
+		left := cells / 2
+		mid := len(vertices) * left / cells
+		split(vertices[:mid], left)
+		split(vertices[mid:], cells-left)
+	}
+	split(vertices, cells)
+	return parts
+}
+
+// Nested partitions from finest to coarsest: every cell of Levels[i] lies
+// inside a single cell of Levels[i+1]
+type MultilevelPartition struct {
+	Levels []*Partition
+}
+
+// Splits the vertices into fanout cells by coordinates, each of those into
+// fanout cells and so on, levels times
+func CoordinateMultilevelPartition(graph *Graph, levels, fanout int) *MultilevelPartition {
+	mp := &MultilevelPartition{Levels: make([]*Partition, levels)}
+	vertices := make([]int, len(graph.Nodes))
+	for i := range vertices {
+		vertices[i] = i
+	}
+	parts := [][]int{vertices}
+	for l := levels - 1; l >= 0; l-- {
+		p := &Partition{Cell: make([]int32, len(graph.Nodes))}
+		children := make([][]int, 0, len(parts)*fanout)
+		for _, part := range parts {
+			children = append(children, coordinateSplit(graph, part, maxInt(minInt(fanout, len(part)), 1))...)
+		}
+		for c, part := range children {
+			for _, v := range part {
+				p.Cell[v] = int32(c)
+			}
+		}
+		p.NumCells = len(children)
+		mp.Levels[l] = p
+		parts = children
+	}
+	return mp
+}
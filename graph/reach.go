@@ -0,0 +1,439 @@
+package graph
+
+import (
+	"container/heap"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// The reach of vertex v on a shortest path from s to t is
+// min(d(s, v), d(v, t)), and the reach of v is its largest reach over all
+// shortest paths. Vertices far from both ends of a query that have small
+// reach, like side streets, cannot be on its shortest path, so a search can
+// skip them:
+//
+// - a search from s may skip w if r(w) < d(s, w) and r(w) < d(w, t)
+//
+// - d(w, t) is not known, but any lower bound works: the radius of the
+// reverse search in a bidirectional search (RE) or a landmark potential (REAL)
+//
+// Reach is taken over shortest paths ordered by (distance, number of arcs)
+// so that ties are broken consistently: every subpath of such a path is
+// itself shortest in that order, which the bounds below rely on.
+
+// Upper bounds on the reach of every vertex of a graph, along with shortcut
+// arcs that bypass chains of degree two vertices so the vertices inside a
+// chain only have the reach of a side street
+type ReachIndex struct {
+	graph *Graph
+	// graph with the shortcuts added, and its reverse
+	forward, backward *Graph
+	// Upper bound on each vertex's reach, math.MaxInt64 if not bounded
+	reach []int
+	// Vertices skipped by each shortcut arc of forward in path order
+	shortcuts map[int][]int32
+}
+
+// Vertices with reach at least limit get no bound. A search settles every
+// vertex within 2(limit + longest arc) of each source, so a limit of a few
+// arcs keeps preprocessing fast while still bounding most local roads.
+func defaultReachLimit(graph *Graph) int {
+	return 8 * meanArcWeight(graph)
+}
+
+// Computes reach bounds for graph using up to workers goroutines (workers
+// <= 0 uses all CPUs). Vertices whose reach is at least limit are never
+// pruned; limit <= 0 picks one from the mean arc weight.
+//
+// Reaches are exact for vertices with reach below limit and found by
+// growing a partial shortest path DAG to radius R = 2(limit + longest arc)
+// from every vertex. In the DAG from s each vertex v has depth d(s, v) and
+// height (the longest DAG path below it), and min(depth, height) is its reach
+// on a real shortest path, so the maximum over all s never overestimates.
+// If v's reach comes from a path from a to b with min(d(a, v), d(v, b)) < limit
+// then that path, started at most one arc before v's depth on the shorter
+// side, fits within R, so the maximum finds it. If v has reach at least
+// limit the same argument shows the maximum is at least limit, so those
+// vertices are marked unbounded.
+func NewReachIndex(graph *Graph, limit, workers int, progress ProgressFunc) (*ReachIndex, error) {
+	if limit <= 0 {
+		limit = defaultReachLimit(graph)
+	}
+	forward, shortcuts, err := addChainShortcuts(graph, limit)
+	if err != nil {
+		return nil, err
+	}
+	longestArc := 0
+	for _, w := range forward.Weights {
+		longestArc = maxInt(longestArc, int(w))
+	}
+	radius := 2 * (limit + longestArc)
+
+	n := len(graph.Nodes)
+	reach := make([]int64, n)
+	scratch := sync.Pool{New: func() interface{} { return newReachScratch(n) }}
+	blocks := (n + reachBlockSize - 1) / reachBlockSize
+	parallelFor(blocks, workers, progress, func(b int) {
+		sc := scratch.Get().(*reachScratch)
+		for s := b * reachBlockSize; s < minInt((b+1)*reachBlockSize, n); s++ {
+			sc.partialReaches(forward, s, radius, reach)
+		}
+		scratch.Put(sc)
+	})
+
+	ri := &ReachIndex{
+		graph:     graph,
+		forward:   forward,
+		backward:  forward.Reverse(),
+		reach:     make([]int, n),
+		shortcuts: shortcuts,
+	}
+	for v, r := range reach {
+		if r >= int64(limit) {
+			ri.reach[v] = math.MaxInt64
+		} else {
+			ri.reach[v] = int(r)
+		}
+	}
+	return ri, nil
+}
+
+// Number of sources handled per unit of parallel work
+const reachBlockSize = 256
+
+// Number of shortcut arcs added
+func (ri *ReachIndex) Shortcuts() int {
+	return len(ri.shortcuts)
+}
+
+// Vertex in a partial search ordered by (distance, arcs)
+type reachEntry struct {
+	dist   int
+	hops   int32
+	vertex int32
+}
+
+type reachQueue []reachEntry
+
+func (q reachQueue) Len() int { return len(q) }
+func (q reachQueue) Less(i, j int) bool {
+	return q[i].dist < q[j].dist || q[i].dist == q[j].dist && q[i].hops < q[j].hops
+}
+func (q reachQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *reachQueue) Push(x interface{}) { *q = append(*q, x.(reachEntry)) }
+func (q *reachQueue) Pop() interface{} {
+	last := (*q)[len(*q)-1]
+	*q = (*q)[:len(*q)-1]
+	return last
+}
+
+// Per worker state for growing partial DAGs, reset after each source by
+// undoing only the vertices touched
+type reachScratch struct {
+	dist    []int
+	hops    []int32
+	settled []bool
+	height  []int
+	order   []int32
+	touched []int32
+	queue   reachQueue
+}
+
+func newReachScratch(n int) *reachScratch {
+	sc := &reachScratch{
+		dist:    make([]int, n),
+		hops:    make([]int32, n),
+		settled: make([]bool, n),
+		height:  make([]int, n),
+	}
+	for i := range sc.dist {
+		sc.dist[i] = math.MaxInt64
+	}
+	return sc
+}
+
+// Grows the shortest path DAG from s to radius and raises reach[v] to v's
+// reach in it
+func (sc *reachScratch) partialReaches(graph *Graph, s, radius int, reach []int64) {
+	sc.dist[s], sc.hops[s] = 0, 0
+	sc.touched = append(sc.touched, int32(s))
+	heap.Push(&sc.queue, reachEntry{0, 0, int32(s)})
+	for sc.queue.Len() > 0 {
+		e := heap.Pop(&sc.queue).(reachEntry)
+		v := int(e.vertex)
+		if sc.settled[v] || e.dist != sc.dist[v] || e.hops != sc.hops[v] {
+			continue
+		}
+		if e.dist > radius {
+			break
+		}
+		sc.settled[v] = true
+		sc.order = append(sc.order, e.vertex)
+		heads, weights := graph.Arcs(v)
+		for i, head := range heads {
+			d, h := e.dist+int(weights[i]), e.hops+1
+			if sc.settled[head] || d > sc.dist[head] || d == sc.dist[head] && h >= sc.hops[head] {
+				continue
+			}
+			if sc.dist[head] == math.MaxInt64 {
+				sc.touched = append(sc.touched, head)
+			}
+			sc.dist[head], sc.hops[head] = d, h
+			heap.Push(&sc.queue, reachEntry{d, h, head})
+		}
+	}
+
+	// Heights from the bottom of the DAG up
+	for i := len(sc.order) - 1; i >= 0; i-- {
+		v := sc.order[i]
+		height := 0
+		heads, weights := graph.Arcs(int(v))
+		for j, c := range heads {
+			if sc.settled[c] && sc.dist[c] == sc.dist[v]+int(weights[j]) && sc.hops[c] == sc.hops[v]+1 {
+				height = maxInt(height, int(weights[j])+sc.height[c])
+			}
+		}
+		sc.height[v] = height
+		r := int64(minInt(sc.dist[v], height))
+		for {
+			old := atomic.LoadInt64(&reach[v])
+			if r <= old || atomic.CompareAndSwapInt64(&reach[v], old, r) {
+				break
+			}
+		}
+	}
+
+	for _, v := range sc.touched {
+		sc.dist[v], sc.hops[v], sc.settled[v], sc.height[v] = math.MaxInt64, 0, false, 0
+	}
+	sc.touched, sc.order, sc.queue = sc.touched[:0], sc.order[:0], sc.queue[:0]
+}
+
+// Reports whether v only connects two other vertices: one arc in from a and
+// one out to b (one way), or arcs both ways to each of a and b (two way)
+func chainInterior(graph, reverse *Graph, v int) bool {
+	out, _ := graph.Arcs(v)
+	in, _ := reverse.Arcs(v)
+	switch {
+	case len(out) == 1 && len(in) == 1:
+		return out[0] != in[0] && int(out[0]) != v && int(in[0]) != v
+	case len(out) == 2 && len(in) == 2:
+		a, b := out[0], out[1]
+		return a != b && int(a) != v && int(b) != v &&
+			(in[0] == a && in[1] == b || in[0] == b && in[1] == a)
+	}
+	return false
+}
+
+// Returns the graph with a shortcut arc along each chain of degree two
+// vertices, splitting chains so no shortcut is longer than maxLength, and
+// the vertices each shortcut skips keyed by its arc index
+func addChainShortcuts(graph *Graph, maxLength int) (*Graph, map[int][]int32, error) {
+	reverse := graph.Reverse()
+	n := len(graph.Nodes)
+	interior := make([]bool, n)
+	for v := range interior {
+		interior[v] = chainInterior(graph, reverse, v)
+	}
+
+	type shortcut struct {
+		src, dest int
+		length    int
+		skipped   []int32
+	}
+	shortcuts := make([]shortcut, 0)
+	add := func(src, dest, length int, skipped []int32) {
+		if len(skipped) > 0 && src != dest && length <= math.MaxUint32 {
+			shortcuts = append(shortcuts, shortcut{src, dest, length, skipped})
+		}
+	}
+	for u := 0; u < n; u++ {
+		if interior[u] {
+			continue
+		}
+		heads, weights := graph.Arcs(u)
+		for i, head := range heads {
+			if !interior[head] {
+				continue
+			}
+			start, length := u, int(weights[i])
+			skipped := make([]int32, 0)
+			prev, cur := u, int(head)
+			for steps := 0; interior[cur] && steps < n; steps++ {
+				// Continue away from the vertex the chain came from
+				next, nextWeights := graph.Arcs(cur)
+				j := 0
+				if len(next) == 2 && int(next[0]) == prev {
+					j = 1
+				}
+				if length+int(nextWeights[j]) > maxLength {
+					add(start, cur, length, skipped)
+					start, length, skipped = cur, 0, make([]int32, 0)
+				} else {
+					skipped = append(skipped, int32(cur))
+				}
+				length += int(nextWeights[j])
+				prev, cur = cur, int(next[j])
+			}
+			add(start, cur, length, skipped)
+		}
+	}
+
+	arcs := make(arcList, 0, len(graph.Heads)+len(shortcuts))
+	for u := 0; u < n; u++ {
+		heads, weights := graph.Arcs(u)
+		for i, head := range heads {
+			arcs = append(arcs, pendingArc{int32(u), head, weights[i]})
+		}
+	}
+	for _, s := range shortcuts {
+		if err := arcs.add(n, s.src, s.dest, s.length); err != nil {
+			return nil, nil, err
+		}
+	}
+	withShortcuts, err := newGraph(graph.Nodes, arcs)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Arcs keep their order within each source, so a source's shortcuts
+	// follow its original arcs
+	next := make([]int, n)
+	for u := range next {
+		next[u] = int(withShortcuts.FirstArc[u]) + int(graph.FirstArc[u+1]-graph.FirstArc[u])
+	}
+	skippedBy := make(map[int][]int32, len(shortcuts))
+	for _, s := range shortcuts {
+		skippedBy[next[s.src]] = s.skipped
+		next[s.src]++
+	}
+	return withShortcuts, skippedBy, nil
+}
+
+// Replaces shortcuts in a path through the graph with shortcuts by the
+// vertices they skip
+func (ri *ReachIndex) unpack(path []int) []int {
+	unpacked := make([]int, 0, len(path))
+	for i, v := range path {
+		if i > 0 {
+			u := path[i-1]
+			best := -1
+			for a := int(ri.forward.FirstArc[u]); a < int(ri.forward.FirstArc[u+1]); a++ {
+				if int(ri.forward.Heads[a]) == v && (best == -1 || ri.forward.Weights[a] < ri.forward.Weights[best]) {
+					best = a
+				}
+			}
+			for _, s := range ri.shortcuts[best] {
+				unpacked = append(unpacked, int(s))
+			}
+		}
+		unpacked = append(unpacked, v)
+	}
+	return unpacked
+}
+
+// Reverse of the unpacked path, matching SearchSequence
+func (ri *ReachIndex) reverseUnpacked(path []int) []int {
+	if path == nil {
+		return make([]int, 0)
+	}
+	unpacked := ri.unpack(path)
+	for i, j := 0, len(unpacked)-1; i < j; i, j = i+1, j-1 {
+		unpacked[i], unpacked[j] = unpacked[j], unpacked[i]
+	}
+	if len(unpacked) == 1 {
+		return make([]int, 0)
+	}
+	return unpacked
+}
+
+// Runs A* from src to dest, skipping vertices whose reach is below both
+// their distance from src and their potential (REAL when potential is a
+// landmark potential). potential must be a lower bound on the distance to
+// dest. Returns the reverse of the shortest path and the sequence of vertices
+// visited like SearchSequence.
+func (ri *ReachIndex) SearchSequence(src, dest int, potential PotentialFunc) ([]int, []int) {
+	state, visitSeq := search(ri.forward, src, dest, potential, func(u, arc, distance int) bool {
+		v := int(ri.forward.Heads[arc])
+		r := ri.reach[v]
+		return r < distance+int(ri.forward.Weights[arc]) && r < potential(v)
+	}, nil)
+	return ri.reverseUnpacked(state.pathTo(dest)), visitSeq
+}
+
+// Runs bidirectional Dijkstra from src and dest with reach pruning (RE).
+// The forward search skips w when r(w) < d(src, w) and r(w) is below the
+// reverse search's radius (or d(w, dest) if the reverse search has already
+// settled w), which is a lower bound on d(w, dest) for every vertex of the
+// shortest path that the reverse search has not settled, and likewise for
+// the reverse search. Pruning breaks the usual stopping rule, so each search
+// stops once its next vertex is at least half the length of the best path
+// seen. Returns the reverse of the shortest path and the sequence of
+// vertices visited by both searches like SearchSequence.
+func (ri *ReachIndex) BidirectionalSearch(src, dest int) ([]int, []int) {
+	n := len(ri.graph.Nodes)
+	graphs := [2]*Graph{ri.forward, ri.backward}
+	states := [2]*SearchState{NewSearchState(n), NewSearchState(n)}
+	relax := func(s *SearchState, u, v, distance int) {
+		if s.Nodes[v].Potential == -1 {
+			s.Nodes[v].Potential = 0
+		}
+		s.Relax(u, v, distance)
+	}
+	relax(states[0], -1, src, 0)
+	relax(states[1], -1, dest, 0)
+	radius := [2]int{0, 0}
+	best, meet := math.MaxInt64, -1
+	visitSeq := make([]int, 0)
+	// Reports whether the search in direction d still needs to run
+	active := func(d int) bool {
+		s := states[d]
+		return s.Len() > 0 && (best == math.MaxInt64 || 2*s.Nodes[s.Heap[0]].Distance < best)
+	}
+
+	for active(0) || active(1) {
+		d := 0
+		if !active(0) || active(1) && states[1].Nodes[states[1].Heap[0]].Distance < states[0].Nodes[states[0].Heap[0]].Distance {
+			d = 1
+		}
+		s, other := states[d], states[1-d]
+		u := Pop(s)
+		s.Nodes[u].Processed = true
+		du := s.Nodes[u].Distance
+		radius[d] = du
+		visitSeq = append(visitSeq, u)
+		if o := other.Nodes[u].Distance; o != math.MaxInt64 && du+o < best {
+			best, meet = du+o, u
+		}
+
+		heads, weights := graphs[d].Arcs(u)
+		for i, head := range heads {
+			v := int(head)
+			if s.Nodes[v].Processed {
+				continue
+			}
+			dv := du + int(weights[i])
+			if r := ri.reach[v]; r < dv {
+				bound := radius[1-d]
+				if other.Nodes[v].Processed {
+					bound = other.Nodes[v].Distance
+				}
+				if r < bound {
+					continue
+				}
+			}
+			relax(s, u, v, dv)
+			if o := other.Nodes[v].Distance; o != math.MaxInt64 && dv+o < best {
+				best, meet = dv+o, v
+			}
+		}
+	}
+	if meet == -1 {
+		return make([]int, 0), visitSeq
+	}
+	path := states[0].pathTo(meet)
+	for v := states[1].Nodes[meet].Pred; v != -1; v = states[1].Nodes[v].Pred {
+		path = append(path, v)
+	}
+	return ri.reverseUnpacked(path), visitSeq
+}
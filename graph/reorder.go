@@ -0,0 +1,187 @@
+package graph
+
+import (
+	"errors"
+	"sort"
+)
+
+// Vertex numbering in DIMACS files has little to do with where vertices are,
+// so neighbours in the road network are often far apart in memory. Renumbering
+// vertices so nearby vertices get nearby indices makes the search state and
+// the compressed rows touched by a search fit in fewer cache lines.
+
+// Returns the index the vertex had in the input files (0 based)
+func (g *Graph) OriginalID(v int) int {
+	if g.originalIDs == nil {
+		return v
+	}
+	return int(g.originalIDs[v])
+}
+
+// Returns the vertex with the given index in the input files (0 based),
+// or -1 if there is no such vertex
+func (g *Graph) Vertex(originalID int) int {
+	if originalID < 0 || originalID >= len(g.Nodes) {
+		return -1
+	}
+	if g.vertexIDs == nil {
+		return originalID
+	}
+	return int(g.vertexIDs[originalID])
+}
+
+// Returns a copy of the graph where vertex order[i] becomes vertex i.
+// Arcs leaving each vertex keep their relative order.
+func (g *Graph) Permute(order []int) (*Graph, error) {
+	n := len(g.Nodes)
+	if len(order) != n {
+		return nil, errors.New("order must contain every vertex")
+	}
+	newID := make([]int32, n)
+	for i := range newID {
+		newID[i] = -1
+	}
+	for i, v := range order {
+		if v < 0 || v >= n || newID[v] != -1 {
+			return nil, errors.New("order must contain every vertex once")
+		}
+		newID[v] = int32(i)
+	}
+
+	p := &Graph{
+		Nodes:       make([]Cord, n),
+		FirstArc:    make([]int32, n+1),
+		Heads:       make([]int32, 0, len(g.Heads)),
+		Weights:     make([]uint32, 0, len(g.Weights)),
+		originalIDs: make([]int32, n),
+		vertexIDs:   make([]int32, n),
+	}
+	if g.SecondWeights != nil {
+		p.SecondWeights = make([]uint32, 0, len(g.SecondWeights))
+	}
+	// Arc each arc of p was, to carry attributes along
+	oldArcs := make([]int32, 0, len(g.Heads))
+	for i, v := range order {
+		p.Nodes[i] = g.Nodes[v]
+		heads, weights := g.Arcs(v)
+		for j, head := range heads {
+			p.Heads = append(p.Heads, newID[head])
+			p.Weights = append(p.Weights, weights[j])
+			if g.SecondWeights != nil {
+				p.SecondWeights = append(p.SecondWeights, g.SecondWeights[int(g.FirstArc[v])+j])
+			}
+			oldArcs = append(oldArcs, g.FirstArc[v]+int32(j))
+		}
+		p.FirstArc[i+1] = int32(len(p.Heads))
+		p.originalIDs[i] = int32(g.OriginalID(v))
+		p.vertexIDs[p.originalIDs[i]] = int32(i)
+	}
+	if g.Attributes != nil {
+		p.Attributes = g.Attributes.permute(oldArcs)
+	}
+	return p, nil
+}
+
+// Orderings that can be passed to Permute, by name
+var VertexOrders = map[string]func(*Graph) []int{
+	"bfs":     BFSOrder,
+	"hilbert": HilbertOrder,
+}
+
+// Returns vertices in breadth first order starting from vertex 0, starting
+// a new search from the lowest unvisited vertex whenever one runs out
+func BFSOrder(g *Graph) []int {
+	visited := make([]bool, len(g.Nodes))
+	order := make([]int, 0, len(g.Nodes))
+	for root := range g.Nodes {
+		if visited[root] {
+			continue
+		}
+		visited[root] = true
+		queue := len(order)
+		order = append(order, root)
+		for ; queue < len(order); queue++ {
+			heads, _ := g.Arcs(order[queue])
+			for _, head := range heads {
+				if !visited[head] {
+					visited[head] = true
+					order = append(order, int(head))
+				}
+			}
+		}
+	}
+	return order
+}
+
+// Side length of the grid coordinates are snapped to for Hilbert ordering
+const hilbertSide = 1 << 16
+
+// Returns the distance of (x, y) along the Hilbert curve filling the grid
+func hilbertIndex(x, y int) int64 {
+	var d int64
+	for s := hilbertSide / 2; s > 0; s /= 2 {
+		rx, ry := 0, 0
+		if x&s > 0 {
+			rx = 1
+		}
+		if y&s > 0 {
+			ry = 1
+		}
+		d += int64(s) * int64(s) * int64((3*rx)^ry)
+		// Rotate the quadrant so the curve lines up
+		if ry == 0 {
+			if rx == 1 {
+				x = hilbertSide - 1 - x
+				y = hilbertSide - 1 - y
+			}
+			x, y = y, x
+		}
+	}
+	return d
+}
+
+// Returns vertices sorted by their position along a Hilbert curve through the
+// bounding box of the coordinates. Vertices close on the curve are close on
+// the map.
+func HilbertOrder(g *Graph) []int {
+	order := make([]int, len(g.Nodes))
+	for i := range order {
+		order[i] = i
+	}
+	if len(order) == 0 {
+		return order
+	}
+	minLat, maxLat, minLong, maxLong := g.Nodes[0].Lat, g.Nodes[0].Lat, g.Nodes[0].Long, g.Nodes[0].Long
+	for _, c := range g.Nodes {
+		minLat, maxLat = minInt(minLat, c.Lat), maxInt(maxLat, c.Lat)
+		minLong, maxLong = minInt(minLong, c.Long), maxInt(maxLong, c.Long)
+	}
+	scale := func(x, min, max int) int {
+		if max == min {
+			return 0
+		}
+		return int(int64(x-min) * (hilbertSide - 1) / int64(max-min))
+	}
+	keys := make([]int64, len(g.Nodes))
+	for i, c := range g.Nodes {
+		keys[i] = hilbertIndex(scale(c.Long, minLong, maxLong), scale(c.Lat, minLat, maxLat))
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return keys[order[a]] < keys[order[b]]
+	})
+	return order
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -151,23 +151,39 @@ func down(s *SearchState, i0, n int) bool {
 	return i > i0
 }
 
+// State of a vertex no search has reached
+var unreached = NodeSearchState{
+	Distance:  math.MaxInt64,
+	Potential: -1,
+	Pred:      -1,
+	Processed: false,
+	Idx:       -1,
+}
+
 func NewSearchState(size int) *SearchState {
 	s := SearchState{
 		Nodes: make([]NodeSearchState, 0, size),
 		Heap:  make([]int, 0, size),
 	}
 	for i := 0; i < size; i++ {
-		s.Nodes = append(s.Nodes, NodeSearchState{
-			Distance:  math.MaxInt64,
-			Potential: -1,
-			Pred:      -1,
-			Processed: false,
-			Idx:       -1,
-		})
+		s.Nodes = append(s.Nodes, unreached)
 	}
 	return &s
 }
 
+// Undoes a search that visited the vertices in visitSeq, leaving the state
+// like a new one. This only touches the vertices the search reached, so
+// many small searches can share one state.
+func (s *SearchState) reset(visitSeq []int) {
+	for _, v := range visitSeq {
+		s.Nodes[v] = unreached
+	}
+	for _, v := range s.Heap {
+		s.Nodes[v] = unreached
+	}
+	s.Heap = s.Heap[:0]
+}
+
 type PotentialFunc func(v int) int
 
 // Potential functions:
@@ -201,54 +217,165 @@ type PotentialFunc func(v int) int
 // and returns the reverse of the shortest path and
 // the sequence of vertices visited
 func SearchSequence(graph *Graph, src, dest int, potential PotentialFunc) ([]int, []int) {
+	state, vistSeq := search(graph, src, dest, potential, nil, nil)
+	return state.reversePathTo(src, dest), vistSeq
+}
+
+// Per query changes to a search
+type SearchOptions struct {
+	// Feasible potential for A*, nil for Dijkstra
+	Potential PotentialFunc
+	// Areas and arcs to stay out of, nil to use the whole graph. Avoiding
+	// arcs only makes distances longer, so potentials stay feasible.
+	Avoid *Avoid
+	// Arc costs to use instead of the weights, nil for the weights
+	Cost *ArcCost
+}
+
+// Per query arc costs, such as weights with a penalty for long arcs
+type ArcCost struct {
+	// Cost of arc, which leaves u. Costs must not be negative.
+	Cost func(u, arc int) int
+	// A factor f such that Cost(u, arc) >= f*weight for every arc, 0 if
+	// none is known. If pi is feasible for the weights then floor(f*pi) is
+	// feasible for the costs, since
+	// floor(f*pi(u)) - floor(f*pi(v)) <= ceil(f*(pi(u) - pi(v))) <= ceil(f*w(u, v)) <= Cost
+	// as costs are integers.
+	LowerBound float64
+}
+
+// Returns the potential to search with: opts.Potential, scaled by the cost
+// lower bound when costs replace the weights, or none if there is no bound
+func (opts SearchOptions) potential() PotentialFunc {
+	if opts.Potential == nil || opts.Cost != nil && opts.Cost.LowerBound <= 0 {
+		return func(int) int { return 0 }
+	}
+	if opts.Cost == nil || opts.Cost.LowerBound == 1 {
+		return opts.Potential
+	}
+	f, potential := opts.Cost.LowerBound, opts.Potential
+	return func(v int) int {
+		return int(f * float64(potential(v)))
+	}
+}
+
+func (opts SearchOptions) cost() arcCost {
+	if opts.Cost == nil {
+		return nil
+	}
+	return func(u, arc, distance int) int {
+		return opts.Cost.Cost(u, arc)
+	}
+}
+
+// Like SearchSequence with per query options. The distances the search
+// works with are costs when opts.Cost is set.
+func Search(graph *Graph, src, dest int, opts SearchOptions) ([]int, []int) {
+	state, vistSeq := search(graph, src, dest, opts.potential(), opts.Avoid.filter(graph, dest), opts.cost())
+	return state.reversePathTo(src, dest), vistSeq
+}
+
+// Returns the path from src to dest in reverse order, empty if dest is
+// unreachable or equal to src
+func (s *SearchState) reversePathTo(src, dest int) []int {
+	// Reconstruct shortest path if vertex is destination is reachable
+	shortestPath := make([]int, 0)
+	if s.Nodes[dest].Distance != math.MaxInt64 {
+		cur := dest
+		for cur != src {
+			shortestPath = append(shortestPath, cur)
+			cur = s.Nodes[cur].Pred
+		}
+		if src != dest {
+			shortestPath = append(shortestPath, src)
+		}
+	}
+	return shortestPath
+}
+
+// Reports whether the search should ignore arc from u, which was reached at
+// distance
+type arcFilter func(u, arc, distance int) bool
+
+// Returns the cost of taking arc from u when u was reached at distance
+type arcCost func(u, arc, distance int) int
+
+// Runs A* from src until dest is settled, not relaxing arcs for which skip
+// returns true (skip may be nil). Arcs cost their weight unless cost is
+// given. Returns the final search state and the sequence of vertices
+// visited.
+func search(graph *Graph, src, dest int, potential PotentialFunc, skip arcFilter, cost arcCost) (*SearchState, []int) {
 	state := NewSearchState(len(graph.Nodes))
+	return state, state.search(graph, src, dest, potential, skip, cost)
+}
+
+// Runs search on the state, which must be new or reset, and returns the
+// sequence of vertices visited
+func (s *SearchState) search(graph *Graph, src, dest int, potential PotentialFunc, skip arcFilter, cost arcCost) []int {
 	vistSeq := make([]int, 0)
 
-	state.Relax(-1, src, 0)
+	s.Relax(-1, src, 0)
 
-	for state.Len() != 0 {
+	for s.Len() != 0 {
 		// Find closest unprocessed reachable vertex
-		u := Pop(state)
+		u := Pop(s)
 
 		vistSeq = append(vistSeq, u)
 
 		if u == dest {
-			// log.Printf("Found: %d, expected: %d\n", state.Nodes[u].Distance, Dijkstra(graph, src)[dest])
+			// log.Printf("Found: %d, expected: %d\n", s.Nodes[u].Distance, Dijkstra(graph, src)[dest])
 			break
 		}
 
 		// Relax edges leaving u
-		state.Nodes[u].Processed = true
-		for _, dest := range graph.AdjacencyLists[u] {
-			v := dest.Dest
-			if !state.Nodes[v].Processed {
+		s.Nodes[u].Processed = true
+		first := int(graph.FirstArc[u])
+		heads, weights := graph.Arcs(u)
+		for i, head := range heads {
+			v := int(head)
+			if !s.Nodes[v].Processed {
+				if weights[i] == ArcClosed || skip != nil && skip(u, first+i, s.Nodes[u].Distance) {
+					continue
+				}
 				// Lazily compute potentials
-				if state.Nodes[v].Potential == -1 {
-					state.Nodes[v].Potential = potential(v)
+				if s.Nodes[v].Potential == -1 {
+					s.Nodes[v].Potential = potential(v)
 				}
-				state.Relax(u, v, state.Nodes[u].Distance+dest.Dist)
+				weight := int(weights[i])
+				if cost != nil {
+					weight = cost(u, first+i, s.Nodes[u].Distance)
+				}
+				s.Relax(u, v, s.Nodes[u].Distance+weight)
 			}
 		}
 	}
+	return vistSeq
+}
 
-	// Reconstruct shortest path if vertex is destination is reachable
-	shortestPath := make([]int, 0)
-	if state.Nodes[dest].Distance != -1 {
-		cur := dest
-		for cur != src {
-			shortestPath = append(shortestPath, cur)
-			cur = state.Nodes[cur].Pred
-		}
-		if src != dest {
-			shortestPath = append(shortestPath, src)
-		}
+// Returns the path from the search's source to dest following predecessors,
+// or nil if dest was not reached
+func (s *SearchState) pathTo(dest int) []int {
+	if s.Nodes[dest].Distance == math.MaxInt64 {
+		return nil
 	}
-
-	return shortestPath, vistSeq
+	path := make([]int, 0)
+	for cur := dest; cur != -1; cur = s.Nodes[cur].Pred {
+		path = append(path, cur)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
 }
 
 // Computes distances from src vertex to every other vertex in graph
 func Dijkstra(graph *Graph, src int) []int {
+	return dijkstra(graph, src, 1)
+}
+
+// Computes distances from src with every arc weight divided by step and
+// rounded down, so the result never overestimates distance/step
+func dijkstra(graph *Graph, src, step int) []int {
 	state := NewSearchState(len(graph.Nodes))
 	vistSeq := make([]int, 0)
 
@@ -262,10 +389,11 @@ func Dijkstra(graph *Graph, src int) []int {
 
 		// Relax edges leaving u
 		state.Nodes[u].Processed = true
-		for _, dest := range graph.AdjacencyLists[u] {
-			v := dest.Dest
-			if !state.Nodes[v].Processed {
-				state.Relax(u, dest.Dest, dest.Dist+state.Nodes[u].Distance)
+		heads, weights := graph.Arcs(u)
+		for i, head := range heads {
+			v := int(head)
+			if !state.Nodes[v].Processed && weights[i] != ArcClosed {
+				state.Relax(u, v, int(weights[i])/step+state.Nodes[u].Distance)
 			}
 		}
 	}
@@ -290,11 +418,7 @@ func PickRandomLandmarks(graph *Graph, n int) []int {
 
 // Returns distance from landmark i to each vertex
 func DistancesFromLandmarks(graph *Graph, landmarks []int) [][]int {
-	distances := make([][]int, len(landmarks))
-	for i, landmark := range landmarks {
-		distances[i] = Dijkstra(graph, landmark)
-	}
-	return distances
+	return ParallelDistancesFromLandmarks(graph, landmarks, 0, nil)
 }
 
 // Find how many hops every element is from src
@@ -309,8 +433,9 @@ func bfs(graph *Graph, src int) []int {
 	for len(queue) > 0 {
 		u := queue[0]
 		queue = queue[1:]
-		for _, dest := range graph.AdjacencyLists[u] {
-			v := dest.Dest
+		heads, _ := graph.Arcs(u)
+		for _, head := range heads {
+			v := int(head)
 			// if undiscovered add to queue
 			if distances[v] == math.MaxInt64 {
 				distances[v] = distances[u] + 1
@@ -322,11 +447,20 @@ func bfs(graph *Graph, src int) []int {
 }
 
 func PickFarthestLandmarks(graph *Graph, n int) []int {
+	return ParallelPickFarthestLandmarks(graph, n, 0, nil)
+}
+
+// Each landmark depends on the ones picked before it, so the searches run one
+// after another, but each breadth first search is spread over workers goroutines
+func ParallelPickFarthestLandmarks(graph *Graph, n, workers int, progress ProgressFunc) []int {
 	// Start with random landmark
 	landmarks := make([]int, 0)
 	landmarks = append(landmarks, rand.Intn(len(graph.Nodes)))
 
-	distanceFromSet := bfs(graph, landmarks[0])
+	distanceFromSet := parallelBFS(graph, landmarks[0], workers)
+	if progress != nil {
+		progress(1, n)
+	}
 
 	// Pick node greatest number of hops from previously picked landmarks as next
 	for i := 1; i < n; i++ {
@@ -340,11 +474,94 @@ func PickFarthestLandmarks(graph *Graph, n int) []int {
 		}
 		landmarks = append(landmarks, next)
 		// Update node distances from set
-		for j, dist := range bfs(graph, next) {
+		for j, dist := range parallelBFS(graph, next, workers) {
 			if dist < distanceFromSet[j] {
 				distanceFromSet[j] = dist
 			}
 		}
+		if progress != nil {
+			progress(i+1, n)
+		}
 	}
 	return landmarks
 }
+
+// Returns the length of the path visiting vertices in order, using the
+// shortest arc between consecutive vertices, or -1 if some arc is missing
+func PathLength(graph *Graph, path []int) int {
+	length := 0
+	for _, a := range PathArcs(graph, path) {
+		if a == -1 {
+			return -1
+		}
+		length += int(graph.Weights[a])
+	}
+	return length
+}
+
+// Returns a reversed copy of path, turning the reversed paths searches
+// return into paths from source to destination
+func Reversed(path []int) []int {
+	r := make([]int, len(path))
+	for i, v := range path {
+		r[len(path)-1-i] = v
+	}
+	return r
+}
+
+// Returns the index of the cheapest arc between each pair of consecutive
+// vertices of path, -1 where there is none
+func PathArcs(graph *Graph, path []int) []int {
+	arcs := make([]int, 0, len(path))
+	for i := 1; i < len(path); i++ {
+		best := -1
+		for _, a := range graph.ArcsBetween(path[i-1], path[i]) {
+			if best == -1 || graph.Weights[a] < graph.Weights[best] {
+				best = int(a)
+			}
+		}
+		arcs = append(arcs, best)
+	}
+	return arcs
+}
+
+// Returns the total second weight of the cheapest arcs along path, or -1 if
+// one is missing or the graph has no second weights
+func PathSecondLength(graph *Graph, path []int) int {
+	if graph.SecondWeights == nil {
+		return -1
+	}
+	length := 0
+	for _, a := range PathArcs(graph, path) {
+		if a == -1 {
+			return -1
+		}
+		length += int(graph.SecondWeights[a])
+	}
+	return length
+}
+
+// Returns the cost of path taking the cheapest open arc between consecutive
+// vertices, or -1 if one is missing. Arcs cost their weight if cost is nil.
+func PathCost(graph *Graph, path []int, cost *ArcCost) int {
+	if cost == nil {
+		return PathLength(graph, path)
+	}
+	total := 0
+	for i := 1; i < len(path); i++ {
+		best := -1
+		for a := int(graph.FirstArc[path[i-1]]); a < int(graph.FirstArc[path[i-1]+1]); a++ {
+			if int(graph.Heads[a]) != path[i] || graph.Weights[a] == ArcClosed {
+				continue
+			}
+			if c := cost.Cost(path[i-1], a); best == -1 || c < best {
+				best = c
+			}
+		}
+		if best == -1 {
+			return -1
+		}
+		total += best
+	}
+	return total
+}
@@ -0,0 +1,230 @@
+package graph
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Travel time of an arc as a piecewise linear function of departure time
+// that repeats every period. Travel time is interpolated between breakpoints
+// and after the last breakpoint heads towards the first one of the next
+// period.
+type TravelTimeFunction struct {
+	// Departure times of the breakpoints, increasing and within [0, period)
+	Times []int
+	// Travel time when departing at each of Times
+	TravelTimes []int
+}
+
+// Travel time when departing at time t
+func (f *TravelTimeFunction) At(t, period int) int {
+	t %= period
+	if t < 0 {
+		t += period
+	}
+	n := len(f.Times)
+	// Last breakpoint at or before t
+	i := sort.SearchInts(f.Times, t+1) - 1
+	var t1, tt1, t2, tt2 int
+	switch {
+	case n == 1:
+		return f.TravelTimes[0]
+	case i == -1:
+		t1, tt1 = f.Times[n-1]-period, f.TravelTimes[n-1]
+		t2, tt2 = f.Times[0], f.TravelTimes[0]
+	case i == n-1:
+		t1, tt1 = f.Times[n-1], f.TravelTimes[n-1]
+		t2, tt2 = f.Times[0]+period, f.TravelTimes[0]
+	default:
+		t1, tt1 = f.Times[i], f.TravelTimes[i]
+		t2, tt2 = f.Times[i+1], f.TravelTimes[i+1]
+	}
+	return tt1 + (tt2-tt1)*(t-t1)/(t2-t1)
+}
+
+// Smallest travel time at any departure time
+func (f *TravelTimeFunction) Min() int {
+	min := f.TravelTimes[0]
+	for _, tt := range f.TravelTimes {
+		if tt < min {
+			min = tt
+		}
+	}
+	return min
+}
+
+// Checks that breakpoints are in order and that the function has the FIFO
+// property: leaving later never means arriving earlier. That holds when
+// arrival time t + f(t) never decreases between breakpoints, i.e. no slope is
+// below -1.
+func (f *TravelTimeFunction) validate(period int) error {
+	n := len(f.Times)
+	if n == 0 || n != len(f.TravelTimes) {
+		return errors.New("travel time function needs at least one breakpoint")
+	}
+	for i := 0; i < n; i++ {
+		if f.Times[i] < 0 || f.Times[i] >= period || i > 0 && f.Times[i] <= f.Times[i-1] {
+			return errors.New("breakpoint times must be increasing and within the period")
+		}
+		if f.TravelTimes[i] < 0 {
+			return errors.New("negative travel time")
+		}
+	}
+	for i := 0; i < n; i++ {
+		t1, tt1 := f.Times[i], f.TravelTimes[i]
+		t2, tt2 := f.Times[(i+1)%n], f.TravelTimes[(i+1)%n]
+		if i == n-1 {
+			t2 += period
+		}
+		if t2+tt2 < t1+tt1 {
+			return fmt.Errorf("travel time falls faster than time passes after %d (not FIFO)", t1)
+		}
+	}
+	return nil
+}
+
+// Travel time functions for some of a graph's arcs. Arcs without a function
+// take their static weight at all times.
+type TimeProfiles struct {
+	// Length of the repeating cycle, such as a day, in the units of arc weights
+	Period int
+	// Travel time function of each arc index that has one
+	Functions map[int]*TravelTimeFunction
+}
+
+// Travel time of arc when departing at time t
+func (p *TimeProfiles) travelTime(graph *Graph, arc, t int) int {
+	if f, ok := p.Functions[arc]; ok {
+		return f.At(t, p.Period)
+	}
+	return int(graph.Weights[arc])
+}
+
+// Returns profiles for the graph after updates. Arcs given a new weight drop
+// their travel time function and take that weight at all times, since the
+// function no longer describes them. Closed arcs keep theirs, which searches
+// skip while the arc is closed. Profiles are shared by searches in flight,
+// so this makes a copy.
+func (p *TimeProfiles) ForUpdates(graph *Graph, updates []ArcUpdate) *TimeProfiles {
+	updated := &TimeProfiles{Period: p.Period, Functions: make(map[int]*TravelTimeFunction, len(p.Functions))}
+	for arc, f := range p.Functions {
+		updated.Functions[arc] = f
+	}
+	for _, u := range updates {
+		if u.Weight == ArcClosed {
+			continue
+		}
+		for _, a := range graph.ArcsBetween(u.Src, u.Dest) {
+			delete(updated.Functions, int(a))
+		}
+	}
+	return updated
+}
+
+// Reports whether no arc is ever faster than its static weight. Potentials
+// that are feasible for the static weights, like landmark potentials, are
+// only valid for time dependent searches when this holds.
+func (p *TimeProfiles) StaticWeightsAreLowerBounds(graph *Graph) bool {
+	for arc, f := range p.Functions {
+		if f.Min() < int(graph.Weights[arc]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Loads travel time functions for graph's arcs from a file of lines
+//
+//	c <comment>
+//	p td <period>
+//	a <src> <dest> <time> <travel time> [<time> <travel time> ...]
+//
+// where src and dest are the 1 based vertex IDs of the arc file and each
+// pair is a breakpoint. The function applies to every arc from src to dest.
+// The period line must come before any arcs.
+func LoadTimeProfiles(graph *Graph, profileFile string) (*TimeProfiles, error) {
+	f, err := os.Open(profileFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	profiles := &TimeProfiles{Functions: make(map[int]*TravelTimeFunction)}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] == "c" {
+			continue
+		}
+		switch fields[0] {
+		case "p":
+			if len(fields) != 3 || fields[1] != "td" {
+				return nil, fmt.Errorf("line %d: expected p td <period>", lineNum)
+			}
+			if profiles.Period, err = strconv.Atoi(fields[2]); err != nil || profiles.Period <= 0 {
+				return nil, fmt.Errorf("line %d: invalid period", lineNum)
+			}
+		case "a":
+			if profiles.Period == 0 {
+				return nil, fmt.Errorf("line %d: arc before period", lineNum)
+			}
+			if len(fields) < 5 || len(fields)%2 != 1 {
+				return nil, fmt.Errorf("line %d: expected a <src> <dest> followed by breakpoints", lineNum)
+			}
+			values := make([]int, len(fields)-1)
+			for i, field := range fields[1:] {
+				if values[i], err = strconv.Atoi(field); err != nil {
+					return nil, fmt.Errorf("line %d: %v", lineNum, err)
+				}
+			}
+			u, v := graph.Vertex(values[0]-1), graph.Vertex(values[1]-1)
+			if u == -1 || v == -1 {
+				return nil, fmt.Errorf("line %d: invalid index", lineNum)
+			}
+			ttf := &TravelTimeFunction{}
+			for i := 2; i < len(values); i += 2 {
+				ttf.Times = append(ttf.Times, values[i])
+				ttf.TravelTimes = append(ttf.TravelTimes, values[i+1])
+			}
+			if err := ttf.validate(profiles.Period); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			arcs := graph.ArcsBetween(u, v)
+			for _, a := range arcs {
+				profiles.Functions[int(a)] = ttf
+			}
+			if len(arcs) == 0 {
+				return nil, fmt.Errorf("line %d: no arc from %d to %d", lineNum, values[0], values[1])
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if profiles.Period == 0 {
+		return nil, errors.New("missing period")
+	}
+	return profiles, nil
+}
+
+// Finds the quickest path from src to dest when leaving at departure, using
+// the travel time functions in profiles. Because every function is FIFO,
+// waiting never helps and Dijkstra's algorithm works unchanged with arrival
+// times as labels. potential must be a lower bound on the remaining travel
+// time at every departure time; a feasible potential for the static weights
+// qualifies when profiles.StaticWeightsAreLowerBounds holds.
+//
+// Returns the path from src to dest (nil if dest is unreachable), the
+// sequence of vertices visited and the travel time (math.MaxInt64 if dest is
+// unreachable).
+func TimeDependentSearch(graph *Graph, profiles *TimeProfiles, src, dest, departure int, potential PotentialFunc) ([]int, []int, int) {
+	state, visitSeq := search(graph, src, dest, potential, nil, func(u, arc, distance int) int {
+		return profiles.travelTime(graph, arc, departure+distance)
+	})
+	return state.pathTo(dest), visitSeq, state.Nodes[dest].Distance
+}
@@ -0,0 +1,379 @@
+package graph
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"sync"
+)
+
+// Transit node routing: long shortest paths almost always pass through one
+// of a few important transit nodes, and from any vertex they are entered
+// through one of a handful of access nodes. With distances between every
+// pair of transit nodes in a table,
+// d(s, t) = min{d(s, a) + D(a, b) + d(b, t) for a in A(s), b in B(t)}
+// whenever some shortest path from s to t passes through a transit node.
+//
+// Transit nodes here cover every arc between the cells of a partition, so
+// every path from one cell to another passes through one of them, and only
+// queries inside a single cell fall back to a normal search. A path that
+// passes no transit node stays inside one cell, so access nodes come from
+// searches inside cells, and a path from the table is unpacked one cell at a
+// time.
+type TransitNodes struct {
+	graph *Graph
+	// Cell of every vertex in the partition
+	cell []int32
+	// Index of every vertex among the transit nodes, -1 if it is not one
+	index []int32
+	// Transit node vertices, table rows and columns follow this order
+	transit []int32
+	// Distances between transit nodes, row major, unreachable32 if there
+	// is no path
+	table []uint32
+	// For every pair of transit nodes, the first transit node after the
+	// row's on a shortest path to the column's (the column's if there is
+	// none in between)
+	next []int32
+	// Forward access nodes of each vertex (transit nodes it reaches without
+	// passing other transit nodes) and backward access nodes, stored in
+	// compressed rows like Graph
+	forwardFirst  []int32
+	forward       []accessNode
+	backwardFirst []int32
+	backward      []accessNode
+	scratch       sync.Pool
+}
+
+// Access node of a vertex: index of the transit node and distance to it
+type accessNode struct {
+	transit int32
+	dist    uint32
+}
+
+// Per worker state for searches, reset after each search by undoing only
+// the vertices touched
+type accessScratch struct {
+	dist    []int
+	settled []bool
+	parent  []int32
+	// First transit node after the source on the path to each vertex, -1
+	// if there is none
+	first   []int32
+	touched []int32
+	queue   reachQueue
+}
+
+func newAccessScratch(n int) *accessScratch {
+	sc := &accessScratch{
+		dist:    make([]int, n),
+		settled: make([]bool, n),
+		parent:  make([]int32, n),
+		first:   make([]int32, n),
+	}
+	for i := range sc.dist {
+		sc.dist[i] = math.MaxInt64
+	}
+	return sc
+}
+
+// Runs A* from s (Dijkstra if potential is nil), following the arcs of s
+// and of the vertices settled after it for which follow returns true. Calls
+// settle for every vertex settled and stops when it returns false. Fills in
+// parent and, for the transit nodes in index, first.
+func (sc *accessScratch) search(graph *Graph, s int, index []int32, potential PotentialFunc, follow func(v int) bool, settle func(v, dist int) bool) {
+	sc.dist[s], sc.parent[s], sc.first[s] = 0, -1, -1
+	sc.touched = append(sc.touched, int32(s))
+	heap.Push(&sc.queue, reachEntry{0, 0, int32(s)})
+	for sc.queue.Len() > 0 {
+		u := int(heap.Pop(&sc.queue).(reachEntry).vertex)
+		// A vertex is first popped at its shortest distance
+		if sc.settled[u] {
+			continue
+		}
+		sc.settled[u] = true
+		if !settle(u, sc.dist[u]) {
+			break
+		}
+		if u != s && !follow(u) {
+			continue
+		}
+		heads, weights := graph.Arcs(u)
+		for i, head := range heads {
+			if weights[i] == ArcClosed {
+				continue
+			}
+			d := sc.dist[u] + int(weights[i])
+			if d < sc.dist[head] {
+				if sc.dist[head] == math.MaxInt64 {
+					sc.touched = append(sc.touched, head)
+				}
+				sc.dist[head], sc.parent[head] = d, int32(u)
+				sc.first[head] = sc.first[u]
+				if sc.first[head] == -1 {
+					sc.first[head] = index[head]
+				}
+				key := d
+				if potential != nil {
+					key += potential(int(head))
+				}
+				heap.Push(&sc.queue, reachEntry{key, 0, head})
+			}
+		}
+	}
+	for _, v := range sc.touched {
+		sc.dist[v], sc.settled[v] = math.MaxInt64, false
+	}
+	sc.touched, sc.queue = sc.touched[:0], sc.queue[:0]
+}
+
+// Computes the transit nodes covering the arcs between cells of partition,
+// the distance table between them and the access nodes of every vertex
+// using up to workers goroutines (workers <= 0 uses all CPUs).
+func NewTransitNodes(graph *Graph, partition *Partition, workers int, progress ProgressFunc) (*TransitNodes, error) {
+	transit := partition.CutVertices(graph)
+	n, k := len(graph.Nodes), len(transit)
+	tn := &TransitNodes{
+		graph:   graph,
+		cell:    partition.Cell,
+		index:   make([]int32, n),
+		transit: make([]int32, k),
+		table:   make([]uint32, k*k),
+		next:    make([]int32, k*k),
+	}
+	tn.scratch.New = func() interface{} { return newAccessScratch(n) }
+	for i := range tn.index {
+		tn.index[i] = -1
+	}
+	for i, v := range transit {
+		tn.index[v] = int32(i)
+		tn.transit[i] = int32(v)
+	}
+	reverse := graph.Reverse()
+
+	// Reports progress over the table rows and both access searches
+	total, done := k+2*n, 0
+	var mu sync.Mutex
+	step := func(count int) {
+		if progress == nil {
+			return
+		}
+		mu.Lock()
+		done += count
+		progress(done, total)
+		mu.Unlock()
+	}
+
+	errs := make([]error, k)
+	parallelFor(k, workers, nil, func(i int) {
+		sc := tn.scratch.Get().(*accessScratch)
+		row, next := tn.table[i*k:(i+1)*k], tn.next[i*k:(i+1)*k]
+		for j := range row {
+			row[j], next[j] = unreachable32, -1
+		}
+		sc.search(graph, transit[i], tn.index, nil, func(int) bool { return true }, func(v, dist int) bool {
+			if j := tn.index[v]; j >= 0 {
+				if dist >= unreachable32 {
+					errs[i] = errors.New("transit node distance does not fit in 32 bits")
+					return false
+				}
+				row[j], next[j] = uint32(dist), sc.first[v]
+			}
+			return true
+		})
+		next[i] = int32(i)
+		tn.scratch.Put(sc)
+		step(1)
+	})
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if tn.forwardFirst, tn.forward, err = tn.accessNodes(graph, reverse, workers, step); err != nil {
+		return nil, err
+	}
+	if tn.backwardFirst, tn.backward, err = tn.accessNodes(reverse, graph, workers, step); err != nil {
+		return nil, err
+	}
+	return tn, nil
+}
+
+// Returns the access nodes of every vertex in compressed rows. A transit
+// node is its own access node. The others of a cell reach the transit
+// nodes at the ends of the graph's arcs leaving its other vertices, so those
+// are searched from on reverse (graph with every arc reversed) through the
+// cell's vertices that are not transit nodes.
+func (tn *TransitNodes) accessNodes(graph, reverse *Graph, workers int, step func(int)) ([]int32, []accessNode, error) {
+	n := len(graph.Nodes)
+	numCells := 0
+	for _, c := range tn.cell {
+		numCells = maxInt(numCells, int(c)+1)
+	}
+	members := make([][]int32, numCells)
+	for v, c := range tn.cell {
+		members[c] = append(members[c], int32(v))
+	}
+	lists := make([][]accessNode, n)
+	errs := make([]error, numCells)
+	parallelFor(numCells, workers, nil, func(c int) {
+		sc := tn.scratch.Get().(*accessScratch)
+		defer tn.scratch.Put(sc)
+		defer step(len(members[c]))
+		inner := func(v int) bool { return tn.index[v] < 0 && tn.cell[v] == int32(c) }
+		seen := make(map[int32]bool)
+		for _, u := range members[c] {
+			if !inner(int(u)) {
+				lists[u] = []accessNode{{tn.index[u], 0}}
+				continue
+			}
+			heads, _ := graph.Arcs(int(u))
+			for _, x := range heads {
+				if tn.index[x] < 0 || seen[x] {
+					continue
+				}
+				seen[x] = true
+				sc.search(reverse, int(x), tn.index, nil, inner, func(v, dist int) bool {
+					if v == int(x) || !inner(v) {
+						return true
+					}
+					if dist > math.MaxUint32 {
+						errs[c] = errors.New("access node distance does not fit in 32 bits")
+						return false
+					}
+					lists[v] = append(lists[v], accessNode{tn.index[x], uint32(dist)})
+					return true
+				})
+			}
+		}
+	})
+	for _, err := range errs {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	first := make([]int32, n+1)
+	for v, list := range lists {
+		if first[v]+int32(len(list)) < first[v] {
+			return nil, nil, errors.New("too many access nodes")
+		}
+		first[v+1] = first[v] + int32(len(list))
+	}
+	all := make([]accessNode, 0, first[n])
+	for _, list := range lists {
+		all = append(all, list...)
+	}
+	return first, all, nil
+}
+
+// Number of transit nodes
+func (tn *TransitNodes) Len() int {
+	return len(tn.transit)
+}
+
+// Average number of forward and backward access nodes per vertex
+func (tn *TransitNodes) AverageAccessNodes() float64 {
+	return float64(len(tn.forward)+len(tn.backward)) / float64(2*len(tn.graph.Nodes))
+}
+
+// Number of bytes used by the tables, access nodes and cells
+func (tn *TransitNodes) Bytes() int {
+	return 4*len(tn.transit) + 4*len(tn.table) + 4*len(tn.next) + 4*(len(tn.cell)+len(tn.index)) +
+		4*(len(tn.forwardFirst)+len(tn.backwardFirst)) + 8*(len(tn.forward)+len(tn.backward))
+}
+
+// Whether the query from s to t is local, so that its shortest paths might
+// all avoid transit nodes. Otherwise s and t are in different cells (or
+// one is a transit node), so every path passes through a transit node.
+func (tn *TransitNodes) IsLocal(s, t int) bool {
+	return tn.index[s] < 0 && tn.index[t] < 0 && tn.cell[s] == tn.cell[t]
+}
+
+// Returns the shortest distance from s to t through access nodes of both
+// and the indices of those access nodes, math.MaxInt64 if there is no such
+// path
+func (tn *TransitNodes) transitDistance(s, t int) (int, int32, int32) {
+	k := len(tn.transit)
+	best, bestA, bestB := math.MaxInt64, int32(-1), int32(-1)
+	for _, a := range tn.forward[tn.forwardFirst[s]:tn.forwardFirst[s+1]] {
+		row := tn.table[int(a.transit)*k : (int(a.transit)+1)*k]
+		for _, b := range tn.backward[tn.backwardFirst[t]:tn.backwardFirst[t+1]] {
+			d := row[b.transit]
+			if d == unreachable32 {
+				continue
+			}
+			if total := int(a.dist) + int(d) + int(b.dist); total < best {
+				best, bestA, bestB = total, a.transit, b.transit
+			}
+		}
+	}
+	return best, bestA, bestB
+}
+
+// Returns the distance from s to t, math.MaxInt64 if t is unreachable.
+// Local queries run Dijkstra.
+func (tn *TransitNodes) Distance(s, t int) int {
+	if tn.IsLocal(s, t) {
+		state, _ := search(tn.graph, s, t, func(int) int { return 0 }, nil, nil)
+		return state.Nodes[t].Distance
+	}
+	d, _, _ := tn.transitDistance(s, t)
+	return d
+}
+
+// Appends to path the shortest path from its last vertex to t that passes
+// no transit node in between, found with A* with potentials(t), and to
+// visitSeq the vertices settled finding it. Such a path stays inside one
+// cell.
+func (tn *TransitNodes) appendLocalPath(path, visitSeq []int, t int, potentials func(t int) PotentialFunc) ([]int, []int) {
+	s := path[len(path)-1]
+	if s == t {
+		return path, visitSeq
+	}
+	sc := tn.scratch.Get().(*accessScratch)
+	defer tn.scratch.Put(sc)
+	reached := false
+	sc.search(tn.graph, s, tn.index, potentials(t), func(v int) bool { return tn.index[v] < 0 }, func(v, dist int) bool {
+		visitSeq = append(visitSeq, v)
+		reached = v == t
+		return !reached
+	})
+	if !reached {
+		return path, visitSeq
+	}
+	first := len(path)
+	for v := int32(t); int(v) != s; v = sc.parent[v] {
+		path = append(path, int(v))
+	}
+	rest := path[first:]
+	for i, j := 0, len(rest)-1; i < j; i, j = i+1, j-1 {
+		rest[i], rest[j] = rest[j], rest[i]
+	}
+	return path, visitSeq
+}
+
+// Returns the reverse of the shortest path from s to t and the vertices
+// looked at like SearchSequence, with potentials(v) giving the potential
+// for searches to v. Local queries run SearchSequence. Otherwise the access
+// nodes a of s and b of t come from the table, and the path is unpacked
+// from s to a, from a through the next transit nodes to b, and from b to t,
+// each part inside one cell.
+func (tn *TransitNodes) SearchSequence(s, t int, potentials func(v int) PotentialFunc) ([]int, []int) {
+	if tn.IsLocal(s, t) {
+		return SearchSequence(tn.graph, s, t, potentials(t))
+	}
+	d, a, b := tn.transitDistance(s, t)
+	if d == math.MaxInt64 {
+		return []int{}, []int{s}
+	}
+	k := int32(len(tn.transit))
+	path, visitSeq := []int{s}, make([]int, 0)
+	path, visitSeq = tn.appendLocalPath(path, visitSeq, int(tn.transit[a]), potentials)
+	for x, steps := a, int32(0); x != b && steps < k; x, steps = tn.next[x*k+b], steps+1 {
+		path, visitSeq = tn.appendLocalPath(path, visitSeq, int(tn.transit[tn.next[x*k+b]]), potentials)
+	}
+	path, visitSeq = tn.appendLocalPath(path, visitSeq, t, potentials)
+	return Reversed(path), visitSeq
+}
@@ -0,0 +1,112 @@
+package graph
+
+import (
+	"math"
+)
+
+// Stand-in cost for unreachable pairs. Large enough that any tour using one
+// is worse than a tour that does not, small enough that sums do not overflow.
+const unreachableCost = 1 << 40
+
+// Cost of visiting stops in order, starting at order[0] and returning to it
+// if closed is set
+func tourCost(matrix [][]int, order []int, closed bool) int {
+	cost := 0
+	arc := func(i, j int) int {
+		if matrix[i][j] == math.MaxInt64 {
+			return unreachableCost
+		}
+		return matrix[i][j]
+	}
+	for i := 1; i < len(order); i++ {
+		cost += arc(order[i-1], order[i])
+	}
+	if closed && len(order) > 1 {
+		cost += arc(order[len(order)-1], order[0])
+	}
+	return cost
+}
+
+// Finds a short order to visit every stop starting from depot, where
+// matrix[i][j] is the distance from stop i to stop j (math.MaxInt64 if there
+// is no path). Returns the stops in visiting order starting with depot. If
+// returnToDepot is set the tour's cost includes getting back to the depot
+// from the last stop.
+//
+// Builds a tour by always going to the nearest unvisited stop, then improves
+// it with 2-opt (reversing a stretch of the tour) and Or-opt (moving a run of
+// up to three stops elsewhere) until neither helps. The matrix need not be
+// symmetric, so every move is checked by recomputing the tour cost, which is
+// fine for the tens of stops in a delivery route.
+func SolveTSP(matrix [][]int, depot int, returnToDepot bool) []int {
+	n := len(matrix)
+	if n == 0 {
+		return []int{}
+	}
+
+	// Nearest neighbour construction
+	visited := make([]bool, n)
+	visited[depot] = true
+	order := []int{depot}
+	for len(order) < n {
+		cur := order[len(order)-1]
+		next := -1
+		for j := 0; j < n; j++ {
+			if !visited[j] && (next == -1 || matrix[cur][j] < matrix[cur][next]) {
+				next = j
+			}
+		}
+		visited[next] = true
+		order = append(order, next)
+	}
+
+	best := tourCost(matrix, order, returnToDepot)
+	candidate := make([]int, n)
+	// Keeps candidate if it is cheaper than the current tour
+	try := func() bool {
+		if cost := tourCost(matrix, candidate, returnToDepot); cost < best {
+			best = cost
+			copy(order, candidate)
+			return true
+		}
+		return false
+	}
+	for improved := true; improved; {
+		improved = false
+		// 2-opt: reverse order[i:j+1], keeping the depot first
+		for i := 1; i < n-1; i++ {
+			for j := i + 1; j < n; j++ {
+				copy(candidate, order)
+				for a, b := i, j; a < b; a, b = a+1, b-1 {
+					candidate[a], candidate[b] = candidate[b], candidate[a]
+				}
+				if try() {
+					improved = true
+				}
+			}
+		}
+		// Or-opt: move order[i:i+length] to before position j
+		for length := 1; length <= 3; length++ {
+			for i := 1; i+length <= n; i++ {
+				for j := 1; j <= n; j++ {
+					if j >= i && j <= i+length {
+						continue
+					}
+					candidate = candidate[:0]
+					for k := 0; k <= n; k++ {
+						if k == j {
+							candidate = append(candidate, order[i:i+length]...)
+						}
+						if k < n && (k < i || k >= i+length) {
+							candidate = append(candidate, order[k])
+						}
+					}
+					if try() {
+						improved = true
+					}
+				}
+			}
+		}
+	}
+	return order
+}
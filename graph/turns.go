@@ -0,0 +1,258 @@
+package graph
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Turn cost that bans a turn
+const TurnBanned = -1
+
+// Banned turns and extra costs for turning from one arc onto the next. A
+// vertex based search cannot honour these, since the cost of leaving a
+// vertex depends on how it was reached, so searches run on the line graph:
+// its vertices are the arcs of the graph, and arc a (u -> v) leads to every
+// arc b leaving v at a cost of turn(a, b) + w(b). Turn costs are not
+// negative, so potentials feasible for the graph applied to the heads of
+// arcs stay feasible for the line graph.
+type TurnTable struct {
+	// Cost of turning back along the way an arc came (u -> v -> u),
+	// TurnBanned to ban U-turns
+	UTurn int
+	// Cost of every other turn at an intersection (a vertex with more than
+	// two arcs leaving it) that changes heading by more than turnAngle
+	// degrees, 0 for none. Going straight on and following bends of a road
+	// between intersections cost nothing.
+	Turn int
+	// Cost of turning from the first arc to the second (arc indices),
+	// TurnBanned for banned turns. These override UTurn and Turn.
+	Turns map[[2]int32]int
+	// Tail of every arc
+	tails []int32
+}
+
+// Loads banned turns and turn costs for graph's arcs from a file of lines
+//
+//	c <comment>
+//	u <cost>
+//	r <from> <via> <to>
+//	t <from> <via> <to> <cost>
+//
+// where vertices are the 1 based IDs of the arc file. A u line sets the cost
+// of every U-turn (-1 bans them), an r line bans turning from the arcs from
+// -> via onto the arcs via -> to, and a t line makes that turn cost extra.
+func LoadTurnTable(graph *Graph, turnFile string) (*TurnTable, error) {
+	f, err := os.Open(turnFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := NewTurnTable(graph)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] == "c" {
+			continue
+		}
+		values := make([]int, len(fields)-1)
+		for i, field := range fields[1:] {
+			if values[i], err = strconv.Atoi(field); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+		}
+		switch {
+		case fields[0] == "u" && len(values) == 1:
+			if values[0] < TurnBanned {
+				return nil, fmt.Errorf("line %d: negative cost", lineNum)
+			}
+			t.UTurn = values[0]
+		case fields[0] == "r" && len(values) == 3, fields[0] == "t" && len(values) == 4:
+			cost := TurnBanned
+			if fields[0] == "t" {
+				if cost = values[3]; cost < 0 {
+					return nil, fmt.Errorf("line %d: negative cost", lineNum)
+				}
+			}
+			from, via, to := graph.Vertex(values[0]-1), graph.Vertex(values[1]-1), graph.Vertex(values[2]-1)
+			if from == -1 || via == -1 || to == -1 {
+				return nil, fmt.Errorf("line %d: invalid index", lineNum)
+			}
+			if err := t.SetTurn(graph, from, via, to, cost); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: expected u <cost>, r <from> <via> <to> or t <from> <via> <to> <cost>", lineNum)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Returns a table for graph's arcs with every turn allowed at no cost
+func NewTurnTable(graph *Graph) *TurnTable {
+	t := &TurnTable{Turns: make(map[[2]int32]int), tails: make([]int32, len(graph.Heads))}
+	for u := range graph.Nodes {
+		for a := graph.FirstArc[u]; a < graph.FirstArc[u+1]; a++ {
+			t.tails[a] = int32(u)
+		}
+	}
+	return t
+}
+
+// Returns a copy of the table that charges cost for every turn, sharing
+// everything else with t
+func (t *TurnTable) WithTurnCost(cost int) *TurnTable {
+	c := *t
+	c.Turn = cost
+	return &c
+}
+
+// Sets the cost (TurnBanned to ban it) of turning from every arc from -> via
+// onto every arc via -> to
+func (t *TurnTable) SetTurn(graph *Graph, from, via, to, cost int) error {
+	in, out := graph.ArcsBetween(from, via), graph.ArcsBetween(via, to)
+	if len(in) == 0 || len(out) == 0 {
+		return fmt.Errorf("no turn from %d through %d to %d", graph.OriginalID(from)+1, graph.OriginalID(via)+1, graph.OriginalID(to)+1)
+	}
+	for _, a := range in {
+		for _, b := range out {
+			t.Turns[[2]int32{a, b}] = cost
+		}
+	}
+	return nil
+}
+
+// Change of heading in degrees above which going from one arc onto the next
+// at an intersection counts as a turn
+const turnAngle = 45
+
+// Cost of turning from arc a onto arc b, which leaves a's head
+func (t *TurnTable) cost(graph *Graph, a, b int32) int {
+	if cost, ok := t.Turns[[2]int32{a, b}]; ok {
+		return cost
+	}
+	if graph.Heads[b] == t.tails[a] {
+		return t.UTurn
+	}
+	if t.Turn > 0 && t.isTurn(graph, a, b) {
+		return t.Turn
+	}
+	return 0
+}
+
+// Reports whether going from arc a onto arc b turns at an intersection.
+// Headings compare longitude differences scaled by the cosine of the
+// latitude with latitude differences, which is close enough over an arc.
+func (t *TurnTable) isTurn(graph *Graph, a, b int32) bool {
+	v := graph.Heads[a]
+	if graph.FirstArc[v+1]-graph.FirstArc[v] <= 2 {
+		return false
+	}
+	u, w := graph.Nodes[t.tails[a]], graph.Nodes[graph.Heads[b]]
+	c := graph.Nodes[v]
+	scale := math.Cos(float64(c.Lat) / 1e6 * math.Pi / 180)
+	x1, y1 := float64(c.Long-u.Long)*scale, float64(c.Lat-u.Lat)
+	x2, y2 := float64(w.Long-c.Long)*scale, float64(w.Lat-c.Lat)
+	if x1 == 0 && y1 == 0 || x2 == 0 && y2 == 0 {
+		return false
+	}
+	angle := math.Atan2(math.Abs(x1*y2-y1*x2), x1*x2+y1*y2)
+	return angle > turnAngle*math.Pi/180
+}
+
+// Runs A* from src to dest on the line graph of graph, which must have the
+// same arcs as the graph the table was made for (its weights may differ).
+// Returns the reverse of the shortest path as vertices, which may visit a
+// vertex more than once to get around a banned turn, the sequence of
+// vertices visited, and the path's cost including turn costs (-1 if dest is
+// unreachable).
+func (t *TurnTable) SearchSequence(graph *Graph, src, dest int, potential PotentialFunc) ([]int, []int, int) {
+	return t.Search(graph, src, dest, SearchOptions{Potential: potential})
+}
+
+// Like SearchSequence with per query options. The path's cost is made of
+// arc costs when opts.Cost is set.
+func (t *TurnTable) Search(graph *Graph, src, dest int, opts SearchOptions) ([]int, []int, int) {
+	potential, skip, arcCost := opts.potential(), opts.Avoid.filter(graph, dest), opts.cost()
+	// Cost of arc b leaving u, reached at distance, or -1 to skip it
+	weight := func(u int, b int32, distance int) int {
+		if graph.Weights[b] == ArcClosed || skip != nil && skip(u, int(b), distance) {
+			return -1
+		}
+		if arcCost != nil {
+			return arcCost(u, int(b), distance)
+		}
+		return int(graph.Weights[b])
+	}
+	visitSeq := []int{src}
+	if src == dest {
+		return make([]int, 0), visitSeq, 0
+	}
+	dist := make([]int, len(graph.Heads))
+	pred := make([]int32, len(graph.Heads))
+	for i := range dist {
+		dist[i] = math.MaxInt64
+	}
+	// Potentials of arc heads, computed once per vertex
+	potentials := make(map[int32]int)
+	key := func(arc int32) int {
+		v := graph.Heads[arc]
+		p, ok := potentials[v]
+		if !ok {
+			p = potential(int(v))
+			potentials[v] = p
+		}
+		return dist[arc] + p
+	}
+	queue := make(reachQueue, 0)
+	for a := graph.FirstArc[src]; a < graph.FirstArc[src+1]; a++ {
+		if w := weight(src, a, 0); w != -1 && w < dist[a] {
+			dist[a], pred[a] = w, -1
+			heap.Push(&queue, reachEntry{key(a), 0, a})
+		}
+	}
+	last := int32(-1)
+	for queue.Len() > 0 {
+		e := heap.Pop(&queue).(reachEntry)
+		a := e.vertex
+		if e.dist != key(a) {
+			continue
+		}
+		v := graph.Heads[a]
+		visitSeq = append(visitSeq, int(v))
+		if int(v) == dest {
+			last = a
+			break
+		}
+		for b := graph.FirstArc[v]; b < graph.FirstArc[v+1]; b++ {
+			turn := t.cost(graph, a, b)
+			if turn == TurnBanned {
+				continue
+			}
+			w := weight(int(v), b, dist[a])
+			if w == -1 {
+				continue
+			}
+			if d := dist[a] + turn + w; d < dist[b] {
+				dist[b], pred[b] = d, a
+				heap.Push(&queue, reachEntry{key(b), 0, b})
+			}
+		}
+	}
+	if last == -1 {
+		return make([]int, 0), visitSeq, -1
+	}
+	path := make([]int, 0)
+	for a := last; a != -1; a = pred[a] {
+		path = append(path, int(graph.Heads[a]))
+	}
+	return append(path, src), visitSeq, dist[last]
+}
@@ -0,0 +1,202 @@
+package graph
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Kind of road an arc is part of, which decides who may use it and how fast
+type RoadClass uint8
+
+const (
+	// Arcs without a class
+	RoadUnclassified RoadClass = iota
+	RoadMotorway
+	RoadPrimary
+	RoadSecondary
+	RoadResidential
+	RoadService
+	RoadCycleway
+	RoadFootway
+	numRoadClasses
+)
+
+var roadClassNames = [numRoadClasses]string{
+	"unclassified", "motorway", "primary", "secondary", "residential", "service", "cycleway", "footway",
+}
+
+func (c RoadClass) String() string {
+	if c < numRoadClasses {
+		return roadClassNames[c]
+	}
+	return "unknown"
+}
+
+// Parses the name of a road class as returned by String
+func ParseRoadClass(s string) (RoadClass, error) {
+	for c, name := range roadClassNames {
+		if name == s {
+			return RoadClass(c), nil
+		}
+	}
+	return 0, errors.New("unknown road class: " + s)
+}
+
+// Loads the road class of graph's arcs from a file of lines
+//
+//	c <comment>
+//	a <src> <dest> <class>
+//
+// where src and dest are the 1 based vertex IDs of the arc file and class is
+// a name like motorway. The class applies to every arc from src to dest.
+// Arcs that are not listed are unclassified.
+func LoadRoadClasses(graph *Graph, classFile string) ([]RoadClass, error) {
+	f, err := os.Open(classFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	classes := make([]RoadClass, len(graph.Heads))
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] == "c" {
+			continue
+		}
+		if fields[0] != "a" || len(fields) != 4 {
+			return nil, fmt.Errorf("line %d: expected a <src> <dest> <class>", lineNum)
+		}
+		src, err1 := strconv.Atoi(fields[1])
+		dest, err2 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("line %d: invalid index", lineNum)
+		}
+		class, err := ParseRoadClass(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		u, v := graph.Vertex(src-1), graph.Vertex(dest-1)
+		if u == -1 || v == -1 {
+			return nil, fmt.Errorf("line %d: invalid index", lineNum)
+		}
+		arcs := graph.ArcsBetween(u, v)
+		for _, a := range arcs {
+			classes[a] = class
+		}
+		if len(arcs) == 0 {
+			return nil, fmt.Errorf("line %d: no arc from %d to %d", lineNum, src, dest)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return classes, nil
+}
+
+// Who is travelling: where they may go and how fast
+type VehicleProfile struct {
+	// Speed on each road class in km/h, 0 where the vehicle may not go
+	Speeds [numRoadClasses]int
+	// Whether one-way arcs can also be used backwards, as by pedestrians
+	IgnoreOneWay bool
+}
+
+// Speed at which a profile's arc weights equal the graph's weights
+const referenceSpeed = 100
+
+// Profiles by name
+var VehicleProfiles = map[string]VehicleProfile{
+	"car": {Speeds: [numRoadClasses]int{
+		RoadUnclassified: 50, RoadMotorway: 110, RoadPrimary: 80, RoadSecondary: 60,
+		RoadResidential: 30, RoadService: 20,
+	}},
+	"bicycle": {Speeds: [numRoadClasses]int{
+		RoadUnclassified: 16, RoadPrimary: 16, RoadSecondary: 16, RoadResidential: 16,
+		RoadService: 14, RoadCycleway: 18,
+	}},
+	"foot": {Speeds: [numRoadClasses]int{
+		RoadUnclassified: 5, RoadPrimary: 5, RoadSecondary: 5, RoadResidential: 5,
+		RoadService: 5, RoadCycleway: 5, RoadFootway: 5,
+	}, IgnoreOneWay: true},
+}
+
+// Builds the graph the profile travels on from graph and the class of each
+// of its arcs. Arcs the profile may not use are left out, and the others
+// weigh their weight times referenceSpeed over the profile's speed (rounded
+// up), so weights are travel times in units of the graph's weights at
+// referenceSpeed km/h. Closed arcs stay closed. With IgnoreOneWay, arcs
+// without an opposite arc the profile may use are added backwards too.
+// SecondWeights hold the graph's weights, so a path's SecondWeights add up
+// to its length.
+//
+// Weights only grow with the graph's weights, so landmark potentials for a
+// profile graph stay feasible for one built after weights increased.
+func (p *VehicleProfile) Graph(graph *Graph, classes []RoadClass) (*Graph, error) {
+	if len(classes) != len(graph.Heads) {
+		return nil, errors.New("need one road class per arc")
+	}
+	arcs := make(arcList, 0, len(graph.Heads))
+	seconds := make([]uint32, 0, len(graph.Heads))
+	add := func(u, v int, weight uint32, speed int) error {
+		w := uint64(ArcClosed)
+		if weight != ArcClosed {
+			w = (uint64(weight)*referenceSpeed + uint64(speed) - 1) / uint64(speed)
+			if w >= ArcClosed {
+				return errors.New("profile arc weight does not fit in 32 bits")
+			}
+		}
+		arcs = append(arcs, pendingArc{int32(u), int32(v), uint32(w)})
+		seconds = append(seconds, weight)
+		return nil
+	}
+	for u := range graph.Nodes {
+		for a := graph.FirstArc[u]; a < graph.FirstArc[u+1]; a++ {
+			speed, v := p.Speeds[classes[a]], int(graph.Heads[a])
+			if speed <= 0 {
+				continue
+			}
+			if err := add(u, v, graph.Weights[a], speed); err != nil {
+				return nil, err
+			}
+			if p.IgnoreOneWay && !p.canUseArc(graph, classes, v, u) {
+				if err := add(v, u, graph.Weights[a], speed); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if len(arcs) > math.MaxInt32 {
+		return nil, errors.New("too many arcs")
+	}
+
+	// Compressed rows as in newGraph, carrying the second weights along
+	g, err := newGraph(graph.Nodes, arcs)
+	if err != nil {
+		return nil, err
+	}
+	g.SecondWeights = make([]uint32, len(arcs))
+	next := make([]int32, len(graph.Nodes))
+	copy(next, g.FirstArc)
+	for i, a := range arcs {
+		g.SecondWeights[next[a.src]] = seconds[i]
+		next[a.src]++
+	}
+	g.originalIDs, g.vertexIDs = graph.originalIDs, graph.vertexIDs
+	return g, nil
+}
+
+// Reports whether the profile may use some arc from u to v
+func (p *VehicleProfile) canUseArc(graph *Graph, classes []RoadClass, u, v int) bool {
+	for _, a := range graph.ArcsBetween(u, v) {
+		if p.Speeds[classes[a]] > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/adrs/shortestpath/graph"
+	"image/gif"
+	"io"
+	"sort"
+)
+
+// Areas reachable from a vertex within each of several budgets
+type Isochrones struct {
+	Src     int
+	Budgets []int
+	// Polygons[i] covers the area reachable within Budgets[i]
+	Polygons [][]graph.Polygon
+	Centerx  int
+	Centery  int
+	Radius   int
+}
+
+// Smallest grid cell used to build isochrone polygons in millionths of a degree
+const minIsochroneCell = 100
+
+// Computes isochrones for budgets sorted in increasing order. If cellSize is
+// 0 the grid resolution is picked from the extent of the largest isochrone.
+func getIsochrones(src int, budgets []int, cellSize int) *Isochrones {
+	sort.Ints(budgets)
+	vertices, distances := graph.WithinDistance(roadNetwork, src, budgets[len(budgets)-1])
+	minLat, maxLat, minLong, maxLong := findCordinateRange(vertices, roadNetwork.Nodes)
+	if cellSize == 0 {
+		cellSize = max(max(maxLong-minLong, maxLat-minLat)/64, minIsochroneCell)
+	}
+	iso := &Isochrones{
+		Src:      src,
+		Budgets:  budgets,
+		Polygons: make([][]graph.Polygon, len(budgets)),
+		Centerx:  (minLong + maxLong) / 2,
+		Centery:  (minLat + maxLat) / 2,
+		Radius:   max(max(maxLong-minLong, maxLat-minLat)*11/20, 5e4),
+	}
+	for i, budget := range budgets {
+		// Vertices are in order of distance
+		n := sort.Search(len(distances), func(j int) bool { return distances[j] > budget })
+		iso.Polygons[i] = graph.ReachablePolygons(roadNetwork, vertices[:n], cellSize)
+	}
+	return iso
+}
+
+type geoJSONGeometry struct {
+	Type string `json:"type"`
+	// Polygons of rings of [longitude, latitude] points
+	Coordinates [][][][2]float64 `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Properties map[string]interface{} `json:"properties"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+func multiPolygon(polygons []graph.Polygon) geoJSONGeometry {
+	geometry := geoJSONGeometry{Type: "MultiPolygon", Coordinates: make([][][][2]float64, len(polygons))}
+	for i, polygon := range polygons {
+		geometry.Coordinates[i] = make([][][2]float64, len(polygon))
+		for j, ring := range polygon {
+			geometry.Coordinates[i][j] = make([][2]float64, len(ring))
+			for k, cord := range ring {
+				geometry.Coordinates[i][j][k] = [2]float64{float64(cord.Long) / 1e6, float64(cord.Lat) / 1e6}
+			}
+		}
+	}
+	return geometry
+}
+
+// One MultiPolygon feature per budget
+func (iso *Isochrones) geoJSON() geoJSONFeatureCollection {
+	collection := geoJSONFeatureCollection{Type: "FeatureCollection", Features: make([]geoJSONFeature, len(iso.Budgets))}
+	for i, budget := range iso.Budgets {
+		collection.Features[i] = geoJSONFeature{
+			Type:       "Feature",
+			Properties: map[string]interface{}{"budget": budget},
+			Geometry:   multiPolygon(iso.Polygons[i]),
+		}
+	}
+	return collection
+}
+
+// Draws the map with the area inside each isochrone shaded by band
+func drawIsochrones(out io.Writer, iso *Isochrones, size int) {
+	radius := iso.Radius
+	minLat := iso.Centery - radius
+	minLong := iso.Centerx - radius
+	img := makeMap(iso.Centerx, iso.Centery, radius, size)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if img.ColorIndexAt(x, y) != backgroundColor {
+				continue
+			}
+			// Inverse of pixelLocation
+			cord := graph.Cord{
+				Lat:  minLat + (size-y)*2*radius/size,
+				Long: minLong + x*2*radius/size,
+			}
+		bands:
+			for i, polygons := range iso.Polygons {
+				for _, polygon := range polygons {
+					if polygon.Contains(cord) {
+						img.SetColorIndex(x, y, uint8(firstBandColor+i%numBandColors))
+						break bands
+					}
+				}
+			}
+		}
+	}
+	x, y := pixelLocation(roadNetwork.Nodes[iso.Src], minLat, minLong, radius, size)
+	drawCircle(img, x, size-y, 5, pathColor)
+	anim := gif.GIF{}
+	anim.Image = append(anim.Image, img)
+	anim.Delay = append(anim.Delay, 0)
+	gif.EncodeAll(out, &anim)
+}
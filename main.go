@@ -1,6 +1,11 @@
 package main
 
 import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/adrs/shortestpath/graph"
 	"image"
@@ -11,9 +16,12 @@ import (
 	"math"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 func inRange(cord graph.Cord, minLat, maxLat, minLong, maxLong int) bool {
@@ -52,6 +60,13 @@ var palette = []color.Color{
 	color.RGBA{0, 0, 0, 255},       // Black
 	//color.RGBA{255, 128, 128, 255}, // Red
 	//color.RGBA{0, 128, 0, 255},     // Green
+	color.RGBA{187, 222, 251, 255}, // Light blue
+	color.RGBA{200, 230, 201, 255}, // Light green
+	color.RGBA{255, 236, 179, 255}, // Light amber
+	color.RGBA{255, 205, 210, 255}, // Light red
+	color.RGBA{225, 190, 231, 255}, // Light purple
+	color.RGBA{255, 140, 0, 255},   // Orange
+	color.RGBA{148, 0, 211, 255},   // Violet
 }
 
 const (
@@ -60,8 +75,17 @@ const (
 	visitedColor    = 3
 	pathColor       = 7
 	landmarkColor   = 5
+	// Isochrone bands from nearest to farthest
+	firstBandColor = 8
+	numBandColors  = 5
 )
 
+// Colors of alternative routes in order
+var alternativeColors = []uint8{4, 13, 6, 14}
+
+// Colors of partition cells, cycled through by cell number
+var cellColors = []uint8{4, 3, 2, 13, 14, 6, 5, 7}
+
 func makeMap(centerx, centery, radius, size int) *image.Paletted {
 	img := image.NewPaletted(image.Rect(0, 0, size, size), palette)
 	for y := 0; y < size; y++ {
@@ -90,6 +114,24 @@ func drawMap(out io.Writer, centerx, centery, radius, size int) {
 	gif.EncodeAll(out, &img)
 }
 
+// Draws the map with every vertex coloured by its cell in mapCells
+func drawCells(out io.Writer, centerx, centery, radius, size int) {
+	img := makeMap(centerx, centery, radius, size)
+	minLat := centery - radius
+	minLong := centerx - radius
+	for v, cord := range roadNetwork.Nodes {
+		if !inRange(cord, minLat, centery+radius, minLong, centerx+radius) {
+			continue
+		}
+		x, y := pixelLocation(cord, minLat, minLong, radius, size)
+		img.SetColorIndex(x, size-y, cellColors[int(mapCells.Cell[v])%len(cellColors)])
+	}
+	anim := gif.GIF{}
+	anim.Image = append(anim.Image, img)
+	anim.Delay = append(anim.Delay, 0)
+	gif.EncodeAll(out, &anim)
+}
+
 func abs(x int) int {
 	if x < 0 {
 		return -x
@@ -161,9 +203,22 @@ func drawCircle(img *image.Paletted, x0, y0, r int, c uint8) {
 }
 
 type ShortestPathInfo struct {
-	Src          int
-	Dest         int
+	Src  int
+	Dest int
+	// Stops between Src and Dest in the order they are visited
+	Waypoints []int
+	// Length of ShortestPath or -1 if Dest is unreachable. For time dependent
+	// searches this is the travel time.
+	Distance int
+	// Cost of ShortestPath when the request changed arc costs, picked a
+	// vehicle or used turn costs (including them), 0 otherwise
+	Cost int
+	// Time of leaving Src or -1 if the search used static weights
+	Departure int
+	// Path in reverse order (from Dest to Src)
 	ShortestPath []int
+	// Other routes from Src to Dest, each from Src to Dest
+	Alternatives [][]int
 	SearchSeq    []int
 	Centerx      int
 	Centery      int
@@ -172,59 +227,277 @@ type ShortestPathInfo struct {
 
 var searchCache map[string]*ShortestPathInfo
 
-func getShortestPath(src, dest int, algorithm string) *ShortestPathInfo {
-	// TODO: validate src and dest
-	key := fmt.Sprintf("%d%s%d", src, algorithm, dest)
-	// TODO: add mutex
-	result, ok := searchCache[key]
-	if ok {
-		return result
+// Guards searchCache, which requests running at once all fill
+var cacheLock sync.Mutex
+
+// Point to point search method picked with the algorithm parameter
+type algorithm struct {
+	ID string
+	// Description for the map's algorithm dropdown
+	Name string
+	// Returns the reverse of the shortest path from src to dest, the
+	// sequence of vertices visited and, for searches charging more than the
+	// weights (like turn costs), the path's cost, otherwise -1
+	search func(src, dest int) ([]int, []int, int)
+}
+
+// Algorithms available on this server in the order they are listed
+var algorithms []algorithm
+
+func algorithmIDs() []string {
+	ids := make([]string, len(algorithms))
+	for i, a := range algorithms {
+		ids[i] = a.ID
 	}
+	return ids
+}
 
-	// Pick potential function based on search method
-	landmarkPotential := func(v int) int {
-		// max{d(L, t) - dist(L, v) for L in landmarks}
-		maxDist := 0
-		for _, distances := range landmarkDistances {
-			// Unreachable -> dont want to deal with underflow
-			if distances[dest] == math.MaxInt64 || distances[v] == math.MaxInt64 {
-				continue
-			}
-			dist := distances[dest] - distances[v]
-			if dist > maxDist {
-				maxDist = dist
-			}
+func findAlgorithm(id string) algorithm {
+	for _, a := range algorithms {
+		if a.ID == id {
+			return a
 		}
-		return maxDist
 	}
+	return algorithms[0]
+}
 
-	var potential graph.PotentialFunc
+// Picks potential function based on search method
+func potentialFor(algorithm string, dest int) graph.PotentialFunc {
 	if algorithm == "dijkstra" {
-		potential = func(int) int { return 0 }
+		return func(int) int { return 0 }
+	}
+	return landmarkDistances.Potential(dest)
+}
+
+// Changes a request makes to its searches. They are searched with Dijkstra
+// or ALT instead of the algorithm's own search, which depends on
+// preprocessing for the unchanged graph.
+type queryChanges struct {
+	// Vehicle whose graph to search, nil for the road network
+	vehicle *vehicle
+	// Areas and arcs to avoid, nil for none
+	avoid *graph.Avoid
+	// Arc costs to use instead of the weights, nil for the weights
+	cost *graph.ArcCost
+	// Cost of every turn at an intersection, 0 for none. Turn costs need the
+	// edge based search.
+	turnCost int
+	// Identifies the changes in searchCache keys
+	key string
+}
+
+// Reports whether searches with the changes may be cached. Avoided areas
+// and costs come with each request, so caching them would add an entry for
+// every distinct request.
+func (c *queryChanges) cacheable() bool {
+	return c.avoid == nil && c.cost == nil && c.turnCost == 0
+}
+
+// Graph the searches run on
+func (c *queryChanges) network() *graph.Graph {
+	if c.vehicle != nil {
+		return c.vehicle.graph
+	}
+	return roadNetwork
+}
+
+// Table for the edge based search charging the turn cost, nil if there is
+// no turn cost
+func (c *queryChanges) turns() *graph.TurnTable {
+	switch {
+	case c.turnCost == 0:
+		return nil
+	case c.vehicle != nil:
+		return c.vehicle.turns.WithTurnCost(c.turnCost)
+	}
+	return plainTurns.WithTurnCost(c.turnCost)
+}
+
+func (c *queryChanges) searchOptions(algorithm string, dest int) graph.SearchOptions {
+	potential := potentialFor(algorithm, dest)
+	if c.vehicle != nil && algorithm != "dijkstra" {
+		potential = c.vehicle.landmarks.Potential(dest)
+	}
+	return graph.SearchOptions{Potential: potential, Avoid: c.avoid, Cost: c.cost}
+}
+
+// Returns the length of a path found with the changes and, if they change
+// arc costs or pick a vehicle, its cost without turn costs
+func (c *queryChanges) measure(path []int) (int, int) {
+	if c.vehicle != nil {
+		return graph.PathSecondLength(c.vehicle.graph, path), graph.PathCost(c.vehicle.graph, path, c.cost)
+	}
+	if c.cost != nil {
+		return graph.PathLength(roadNetwork, path), graph.PathCost(roadNetwork, path, c.cost)
+	}
+	return graph.PathLength(roadNetwork, path), 0
+}
+
+// Finds the shortest path from src to dest with up to alternatives other
+// routes. If departure is not -1 and profiles are loaded, finds the quickest
+// path when leaving at departure instead, without alternatives. If changes
+// is not nil, finds the cheapest path with them instead, without
+// alternatives. Edge based searches report the cost including turn costs.
+func getShortestPath(src, dest int, algorithm string, alternatives, departure int, changes *queryChanges) *ShortestPathInfo {
+	// TODO: validate src and dest
+	if profiles == nil {
+		departure = -1
+	}
+	key := fmt.Sprintf("%d%s%d/%d@%d", src, algorithm, dest, alternatives, departure)
+	cache := changes == nil || changes.cacheable()
+	if changes != nil {
+		key += changes.key
+	}
+	if cache {
+		cacheLock.Lock()
+		result, ok := searchCache[key]
+		cacheLock.Unlock()
+		if ok {
+			return result
+		}
+	}
+	if departure != -1 {
+		result := getTimeDependentPath(src, dest, algorithm, departure)
+		if cache {
+			cacheLock.Lock()
+			searchCache[key] = result
+			cacheLock.Unlock()
+		}
+		return result
+	}
+
+	var shortestPath, searchSeq []int
+	// Cost including turn costs from the edge based search, -1 if it did
+	// not run or dest is unreachable
+	turnsCost := -1
+	if changes != nil && changes.turns() != nil {
+		shortestPath, searchSeq, turnsCost = changes.turns().Search(changes.network(), src, dest, changes.searchOptions(algorithm, dest))
+	} else if changes != nil {
+		shortestPath, searchSeq = graph.Search(changes.network(), src, dest, changes.searchOptions(algorithm, dest))
 	} else {
-		potential = landmarkPotential
+		shortestPath, searchSeq, turnsCost = findAlgorithm(algorithm).search(src, dest)
+	}
+	alternativePaths := make([][]int, 0)
+	if alternatives > 0 && changes == nil {
+		opts := graph.DefaultAlternativeOptions
+		opts.Max = alternatives
+		// The first route is the shortest path, and there is none when dest
+		// is unreachable
+		routes := graph.AlternativeRoutes(roadNetwork, reverseNetwork, src, dest, opts)
+		if len(routes) > 1 {
+			for _, route := range routes[1:] {
+				alternativePaths = append(alternativePaths, route.Vertices)
+			}
+		}
 	}
-	shortestPath, searchSeq := graph.SearchSequence(roadNetwork, src, dest, potential)
 
-	// Determine bounds from search sequence
-	minLat, maxLat, minLong, maxLong := findCordinateRange(searchSeq, roadNetwork.Nodes)
-	centerx := (minLong + maxLong) / 2
-	centery := (minLat + maxLat) / 2
-	radius := max(max(maxLong-minLong, maxLat-minLat)*11/20, 5e4)
-	result = &ShortestPathInfo{
+	distance, cost := -1, 0
+	if len(shortestPath) > 0 || src == dest {
+		if changes != nil {
+			distance, cost = changes.measure(graph.Reversed(shortestPath))
+		} else {
+			distance = graph.PathLength(roadNetwork, graph.Reversed(shortestPath))
+		}
+		if turnsCost != -1 {
+			cost = turnsCost
+		}
+	}
+	result := &ShortestPathInfo{
 		Src:          src,
 		Dest:         dest,
+		Distance:     distance,
+		Cost:         cost,
+		Departure:    -1,
 		ShortestPath: shortestPath,
+		Alternatives: alternativePaths,
 		SearchSeq:    searchSeq,
-		Centerx:      centerx,
-		Centery:      centery,
-		Radius:       radius,
 	}
+	result.fitToSearch()
 	// TODO: evict if cache is too full
-	searchCache[key] = result
+	if cache {
+		cacheLock.Lock()
+		searchCache[key] = result
+		cacheLock.Unlock()
+	}
 	return result
 }
 
+func getTimeDependentPath(src, dest int, algorithm string, departure int) *ShortestPathInfo {
+	// Landmark potentials only bound travel times if no arc gets faster
+	potential := potentialFor("dijkstra", dest)
+	if algorithm == "alt" && staticLowerBounds {
+		potential = potentialFor(algorithm, dest)
+	}
+	path, searchSeq, travelTime := graph.TimeDependentSearch(roadNetwork, profiles, src, dest, departure, potential)
+	if path == nil {
+		path, travelTime = []int{}, -1
+	}
+	result := &ShortestPathInfo{
+		Src:          src,
+		Dest:         dest,
+		Distance:     travelTime,
+		Departure:    departure,
+		ShortestPath: graph.Reversed(path),
+		Alternatives: make([][]int, 0),
+		SearchSeq:    searchSeq,
+	}
+	result.fitToSearch()
+	return result
+}
+
+// Determine bounds from search sequence
+func (pathInfo *ShortestPathInfo) fitToSearch() {
+	minLat, maxLat, minLong, maxLong := findCordinateRange(pathInfo.SearchSeq, roadNetwork.Nodes)
+	pathInfo.Centerx = (minLong + maxLong) / 2
+	pathInfo.Centery = (minLat + maxLat) / 2
+	pathInfo.Radius = max(max(maxLong-minLong, maxLat-minLat)*11/20, 5e4)
+}
+
+// Finds the route visiting stops in order by joining the shortest paths
+// between consecutive stops. Returns the whole route and each leg. If
+// departure is not -1 each leg leaves when the previous one arrives.
+func getMultiStopPath(stops []int, algorithm string, departure int, changes *queryChanges) (*ShortestPathInfo, []*ShortestPathInfo) {
+	legs := make([]*ShortestPathInfo, 0, len(stops)-1)
+	for i := 1; i < len(stops); i++ {
+		leg := getShortestPath(stops[i-1], stops[i], algorithm, 0, departure, changes)
+		if departure != -1 && leg.Distance != -1 {
+			departure += leg.Distance
+		}
+		legs = append(legs, leg)
+	}
+	if len(legs) == 1 {
+		return legs[0], legs
+	}
+	route := &ShortestPathInfo{
+		Src:          stops[0],
+		Dest:         stops[len(stops)-1],
+		Waypoints:    stops[1 : len(stops)-1],
+		Departure:    legs[0].Departure,
+		ShortestPath: make([]int, 0),
+		Alternatives: make([][]int, 0),
+		SearchSeq:    make([]int, 0),
+	}
+	for i := len(legs) - 1; i >= 0; i-- {
+		path := legs[i].ShortestPath
+		// Consecutive legs share the stop between them
+		if len(route.ShortestPath) > 0 && len(path) > 0 {
+			path = path[1:]
+		}
+		route.ShortestPath = append(route.ShortestPath, path...)
+	}
+	for _, leg := range legs {
+		route.SearchSeq = append(route.SearchSeq, leg.SearchSeq...)
+		if leg.Distance == -1 || route.Distance == -1 {
+			route.Distance = -1
+		} else {
+			route.Distance += leg.Distance
+			route.Cost += leg.Cost
+		}
+	}
+	route.fitToSearch()
+	return route, legs
+}
+
 // TODO: cache src, dst, algorithm -> results
 func drawShortestPath(out io.Writer, pathInfo *ShortestPathInfo, size, frames, delay int, xoffset, yoffset, zoom float64) {
 	// TODO: fix offset part (handle clientside?)
@@ -243,6 +516,9 @@ func drawShortestPath(out io.Writer, pathInfo *ShortestPathInfo, size, frames, d
 	if frames > 1 {
 		stepsPerFrame /= (frames - 1)
 	}
+	if stepsPerFrame == 0 {
+		stepsPerFrame = 1
+	}
 
 	// Draw landmarks and endpoints of path
 	pointSize := 5
@@ -253,6 +529,9 @@ func drawShortestPath(out io.Writer, pathInfo *ShortestPathInfo, size, frames, d
 		}
 		drawNode(pathInfo.Src, pathColor)
 		drawNode(pathInfo.Dest, pathColor)
+		for _, u := range pathInfo.Waypoints {
+			drawNode(u, pathColor)
+		}
 		for _, u := range landmarks {
 			drawNode(u, landmarkColor)
 		}
@@ -274,6 +553,18 @@ func drawShortestPath(out io.Writer, pathInfo *ShortestPathInfo, size, frames, d
 		}
 	}
 
+	// Show alternatives under the shortest path
+	for i, path := range pathInfo.Alternatives {
+		for _, v := range path {
+			cord := roadNetwork.Nodes[v]
+			if !inRange(cord, minLat, maxLat, minLong, maxLong) {
+				continue
+			}
+			x, y := pixelLocation(cord, minLat, minLong, radius, size)
+			img.SetColorIndex(x, size-y, alternativeColors[i%len(alternativeColors)])
+		}
+	}
+
 	// Show shortest path
 	for _, v := range pathInfo.ShortestPath {
 		cord := roadNetwork.Nodes[v]
@@ -290,20 +581,438 @@ func drawShortestPath(out io.Writer, pathInfo *ShortestPathInfo, size, frames, d
 }
 
 var roadNetwork *graph.Graph
+
+// roadNetwork with every arc reversed
+var reverseNetwork *graph.Graph
 var landmarks []int
-var landmarkDistances [][]int
+var landmarkDistances *graph.LandmarkDistances
+
+// Travel time functions for time dependent searches, nil if none were loaded
+var profiles *graph.TimeProfiles
+
+// Whether landmark potentials are valid for time dependent searches
+var staticLowerBounds bool
+
+// Banned turns and turn costs for the turns algorithm, nil if none were
+// loaded
+var turnTable *graph.TurnTable
+
+// Table without restrictions for the road network's arcs, for queries with
+// a turn cost
+var plainTurns *graph.TurnTable
+
+// Road network as travelled by a vehicle profile, with landmark distances
+// of its own since its weights differ
+type vehicle struct {
+	profile   graph.VehicleProfile
+	graph     *graph.Graph
+	landmarks *graph.LandmarkDistances
+	// Table without restrictions for the vehicle's arcs, for queries with a
+	// turn cost
+	turns *graph.TurnTable
+}
+
+// Vehicles selectable per request by profile name and the road class of
+// every arc they were built from, nil if no road classes were loaded
+var vehicles map[string]*vehicle
+var roadClasses []graph.RoadClass
 
-func setup(nodeFilePath, vertexFilePath string) {
+// Builds the graph of a vehicle profile from g and computes landmark
+// distances for it
+func newVehicle(g *graph.Graph, name string, numLandmarks int, format graph.LandmarkFormat, workers int) (*vehicle, error) {
+	profile := graph.VehicleProfiles[name]
+	vg, err := profile.Graph(g, roadClasses)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Computing %s landmarks...", name)
+	vlandmarks := graph.ParallelPickFarthestLandmarks(vg, numLandmarks, workers, nil)
+	distances, err := graph.NewLandmarkDistances(vg, vlandmarks, format, workers, logProgress("Computed "+name+" landmark distances"))
+	if err != nil {
+		return nil, err
+	}
+	return &vehicle{profile, vg, distances, graph.NewTurnTable(vg)}, nil
+}
+
+// Hub labels for distance queries, nil if they were not requested
+var hubLabels *graph.HubLabels
+
+// Partition drawn by the cells map mode, nil if none was requested
+var mapCells *graph.Partition
+
+// Overlay for customizable route planning and the metric its queries use,
+// nil if they were not requested
+var crpOverlay *graph.Overlay
+var crpMetric *graph.CustomizedMetric
+
+// Customizes the overlay for arc weights (graph.ArcClosed for closed arcs)
+func customizeRoutes(weights []uint32, workers int) (*graph.CustomizedMetric, error) {
+	start := time.Now()
+	m, err := crpOverlay.Customize(weights, workers)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Customized %d clique arcs in %v", crpOverlay.CliqueArcs(), time.Since(start))
+	return m, nil
+}
+
+// Guards the road network and everything computed from it. Requests hold
+// the read lock while they run, so an arc update takes effect between
+// requests and no request sees part of one.
+var networkLock sync.RWMutex
+
+// Serves pattern with handler holding the network read lock
+func handleWithNetwork(pattern string, handler http.HandlerFunc) {
+	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		networkLock.RLock()
+		defer networkLock.RUnlock()
+		handler(w, r)
+	})
+}
+
+// Serializes arc updates. Only updates change roadNetwork, so an update can
+// read it without networkLock.
+var updateLock sync.Mutex
+
+// Algorithms whose searches stay correct when arc weights change. The others
+// rely on preprocessing done for the old weights.
+var weightIndependent = map[string]bool{"dijkstra": true, "alt": true, "crp": true, "turns": true}
+
+type ArcUpdateResponse struct {
+	// Whether landmark distances were recomputed because an arc got cheaper
+	LandmarksRecomputed bool
+	// Algorithms available from now on
+	Algorithms []string
+}
+
+// Changes the weights of arcs of the road network. The new network,
+// landmark distances and CRP metric are prepared while requests go on with
+// the old ones, then swapped in at once and the search cache is emptied.
+// Landmark distances are kept if no arc got cheaper, since their potentials
+// stay feasible, and recomputed otherwise. Algorithms that rely on other
+// preprocessing, and hub labels, are dropped, and arcs given a new weight
+// lose their travel time profiles. Updates that change no weight keep
+// everything.
+func updateArcs(updates []graph.ArcUpdate, workers int) (*ArcUpdateResponse, error) {
+	updateLock.Lock()
+	defer updateLock.Unlock()
+	g, increasing, err := roadNetwork.UpdateArcs(updates)
+	if err != nil {
+		return nil, err
+	}
+	if g == roadNetwork {
+		return &ArcUpdateResponse{Algorithms: algorithmIDs()}, nil
+	}
+	distances := landmarkDistances
+	if !increasing {
+		log.Print("Recomputing distances to landmarks...")
+		distances, err = graph.NewLandmarkDistances(g, landmarks, distances.Format, workers, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var metric *graph.CustomizedMetric
+	if crpOverlay != nil {
+		if metric, err = customizeRoutes(g.Weights, workers); err != nil {
+			return nil, err
+		}
+	}
+	updated := make(map[string]*vehicle, len(vehicles))
+	for name, v := range vehicles {
+		vg, err := v.profile.Graph(g, roadClasses)
+		if err != nil {
+			return nil, err
+		}
+		// Profile weights only grow with the network's, like landmark
+		// distances they are kept unless an arc got cheaper
+		vehicleDistances := v.landmarks
+		if !increasing {
+			log.Printf("Recomputing distances to %s landmarks...", name)
+			vehicleDistances, err = graph.NewLandmarkDistances(vg, v.landmarks.Landmarks, v.landmarks.Format, workers, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+		updated[name] = &vehicle{v.profile, vg, vehicleDistances, graph.NewTurnTable(vg)}
+	}
+	reverse := g.Reverse()
+	timeProfiles := profiles
+	if profiles != nil {
+		timeProfiles = profiles.ForUpdates(g, updates)
+	}
+	lowerBounds := timeProfiles != nil && timeProfiles.StaticWeightsAreLowerBounds(g)
+	live := make([]algorithm, 0, len(algorithms))
+	for _, a := range algorithms {
+		if weightIndependent[a.ID] {
+			live = append(live, a)
+		}
+	}
+
+	networkLock.Lock()
+	defer networkLock.Unlock()
+	roadNetwork, reverseNetwork = g, reverse
+	landmarkDistances, crpMetric, staticLowerBounds = distances, metric, lowerBounds
+	profiles = timeProfiles
+	if vehicles != nil {
+		vehicles = updated
+	}
+	hubLabels = nil
+	algorithms = live
+	searchCache = make(map[string]*ShortestPathInfo)
+	log.Printf("Applied %d arc updates", len(updates))
+	return &ArcUpdateResponse{LandmarksRecomputed: !increasing, Algorithms: algorithmIDs()}, nil
+}
+
+// Computes distances from every source to every target with hub labels if
+// there are any, otherwise with one Dijkstra per source
+func distanceMatrix(sources, targets []int) [][]int {
+	if hubLabels != nil {
+		return hubLabels.DistanceMatrix(sources, targets)
+	}
+	return graph.DistanceMatrix(roadNetwork, sources, targets, 0)
+}
+
+// Returns a progress function that logs how many steps of a task are done
+func logProgress(task string) graph.ProgressFunc {
+	return func(done, total int) {
+		log.Printf("%s: %d/%d", task, done, total)
+	}
+}
+
+// Input files and preprocessing options from the command line
+type config struct {
+	nodeFile       string
+	arcFile        string
+	secondCostFile string
+	// File of arc attributes, which can be the arc file when it has them
+	attributeFile string
+	profileFile   string
+	turnFile      string
+	// File of road classes per arc and the vehicle profiles to build from
+	// them. Without the file the classes come from the arc attributes, if
+	// they were loaded.
+	classFile string
+	vehicles  []string
+	order     string
+	// Partitioning method for arc flags, transit nodes and the cells map.
+	// CRP needs nested cells and always splits by coordinates.
+	partitioner string
+	// Number of cells to draw in the cells map mode, 0 for none
+	mapCells       int
+	numLandmarks   int
+	landmarkFormat graph.LandmarkFormat
+	// Number of cells to compute arc flags for, 0 to skip arc flags
+	arcFlagCells int
+	// Whether to compute reach bounds, and the distance above which they
+	// are not bounded (0 for the default)
+	reach      bool
+	reachLimit int
+	// File to load hub labels from, or to save them to after building them
+	// if it does not exist. Empty to skip hub labels.
+	hubLabelFile string
+	// Number of partition levels for customizable route planning (0 to skip
+	// it) and cells per cell of the level above
+	crpLevels int
+	crpFanout int
+	// Number of cells whose cut vertices become transit nodes, 0 to skip
+	// transit node routing
+	transitCells int
+	workers      int
+}
+
+// Loads hub labels from file, or builds them and saves them there if the
+// file does not exist yet
+func loadOrBuildHubLabels(g *graph.Graph, file string, workers int) (*graph.HubLabels, error) {
+	if in, err := os.Open(file); err == nil {
+		defer in.Close()
+		log.Printf("Loading hub labels from %s...", file)
+		return graph.LoadHubLabels(g, bufio.NewReader(in))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	log.Print("Ordering hubs...")
+	order := graph.HubOrder(g, hubOrderSamples, workers)
+	log.Print("Computing hub labels...")
+	hl, err := graph.NewHubLabels(g, order, logProgress("Computed hub labels"))
+	if err != nil {
+		return nil, err
+	}
+	out, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(out)
+	if err := hl.Save(w); err != nil {
+		out.Close()
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return nil, err
+	}
+	return hl, out.Close()
+}
+
+// Shortest path trees sampled to order hubs by importance
+const hubOrderSamples = 32
+
+func setup(cfg config) {
 	log.Print("Loading graph...")
-	g, err := graph.LoadGraph(nodeFilePath, vertexFilePath)
+	g, err := graph.LoadGraph(cfg.nodeFile, cfg.arcFile)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if cfg.secondCostFile != "" {
+		log.Print("Loading second arc costs...")
+		if err := g.LoadSecondWeights(cfg.secondCostFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.attributeFile != "" {
+		log.Print("Loading arc attributes...")
+		if err := g.LoadArcAttributes(cfg.attributeFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Arc attributes use %d bytes", g.Attributes.Bytes())
+	}
+	if cfg.order != "none" {
+		log.Printf("Reordering vertices in %s order...", cfg.order)
+		g, err = g.Permute(graph.VertexOrders[cfg.order](g))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.profileFile != "" {
+		log.Print("Loading travel time profiles...")
+		if profiles, err = graph.LoadTimeProfiles(g, cfg.profileFile); err != nil {
+			log.Fatal(err)
+		}
+		staticLowerBounds = profiles.StaticWeightsAreLowerBounds(g)
+		if !staticLowerBounds {
+			log.Print("Some profiles are faster than static weights, time dependent ALT will use Dijkstra")
+		}
+	}
+	plainTurns = graph.NewTurnTable(g)
+	turnTable = nil
+	if cfg.turnFile != "" {
+		log.Print("Loading turn restrictions...")
+		if turnTable, err = graph.LoadTurnTable(g, cfg.turnFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded %d turns", len(turnTable.Turns))
+	}
 	log.Print("Picking landmarks...")
-	landmarks = graph.PickFarthestLandmarks(g, 16)
+	landmarks = graph.ParallelPickFarthestLandmarks(g, cfg.numLandmarks, cfg.workers, logProgress("Picked landmarks"))
 	log.Print("Computing distances to landmarks...")
-	landmarkDistances = graph.DistancesFromLandmarks(g, landmarks)
+	landmarkDistances, err = graph.NewLandmarkDistances(g, landmarks, cfg.landmarkFormat, cfg.workers, logProgress("Computed landmark distances"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Landmark distances use %d bytes", landmarkDistances.Bytes())
+	vehicles, roadClasses = nil, nil
+	if cfg.classFile != "" || g.Attributes != nil {
+		if cfg.classFile == "" {
+			roadClasses = g.Attributes.Classes
+		} else {
+			log.Print("Loading road classes...")
+			if roadClasses, err = graph.LoadRoadClasses(g, cfg.classFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		vehicles = make(map[string]*vehicle)
+		for _, name := range cfg.vehicles {
+			if vehicles[name], err = newVehicle(g, name, cfg.numLandmarks, cfg.landmarkFormat, cfg.workers); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 	roadNetwork = g
+	reverseNetwork = g.Reverse()
+	algorithms = []algorithm{
+		{"dijkstra", "Dijkstra", func(src, dest int) ([]int, []int, int) {
+			path, searchSeq := graph.SearchSequence(roadNetwork, src, dest, potentialFor("dijkstra", dest))
+			return path, searchSeq, -1
+		}},
+		{"alt", "ALT (A*, landmarks, triangle inequality)", func(src, dest int) ([]int, []int, int) {
+			path, searchSeq := graph.SearchSequence(roadNetwork, src, dest, potentialFor("alt", dest))
+			return path, searchSeq, -1
+		}},
+	}
+	if turnTable != nil {
+		algorithms = append(algorithms, algorithm{"turns", "ALT with turn restrictions (edge based)", func(src, dest int) ([]int, []int, int) {
+			return turnTable.SearchSequence(roadNetwork, src, dest, potentialFor("alt", dest))
+		}})
+	}
+	if cfg.arcFlagCells > 0 {
+		log.Printf("Computing arc flags for %d cells...", cfg.arcFlagCells)
+		partition := graph.Partitioners[cfg.partitioner](g, cfg.arcFlagCells, cfg.workers)
+		flags := graph.NewArcFlags(g, reverseNetwork, partition, cfg.workers, logProgress("Computed arc flags"))
+		log.Printf("Arc flags use %d bytes", flags.Bytes())
+		algorithms = append(algorithms, algorithm{"arcflags", "Arc flags (Dijkstra pruned by region)", func(src, dest int) ([]int, []int, int) {
+			path, searchSeq := flags.SearchSequence(roadNetwork, src, dest)
+			return path, searchSeq, -1
+		}})
+	}
+	if cfg.reach {
+		log.Print("Computing reach bounds...")
+		reaches, err := graph.NewReachIndex(g, cfg.reachLimit, cfg.workers, logProgress("Computed reaches"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Added %d shortcuts", reaches.Shortcuts())
+		algorithms = append(algorithms,
+			algorithm{"re", "RE (bidirectional Dijkstra, reach pruning)", func(src, dest int) ([]int, []int, int) {
+				path, searchSeq := reaches.BidirectionalSearch(src, dest)
+				return path, searchSeq, -1
+			}},
+			algorithm{"real", "REAL (ALT with reach pruning)", func(src, dest int) ([]int, []int, int) {
+				path, searchSeq := reaches.SearchSequence(src, dest, potentialFor("alt", dest))
+				return path, searchSeq, -1
+			}})
+	}
+	hubLabels = nil
+	if cfg.hubLabelFile != "" {
+		if hubLabels, err = loadOrBuildHubLabels(g, cfg.hubLabelFile, cfg.workers); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Hub labels use %d bytes, %.1f hubs per label", hubLabels.Bytes(), hubLabels.AverageLabelSize())
+		algorithms = append(algorithms, algorithm{"hl", "Hub labels", func(src, dest int) ([]int, []int, int) {
+			path, searchSeq := hubLabels.SearchSequence(src, dest)
+			return path, searchSeq, -1
+		}})
+	}
+	if cfg.transitCells > 0 {
+		log.Printf("Computing transit nodes for %d cells...", cfg.transitCells)
+		partition := graph.Partitioners[cfg.partitioner](g, cfg.transitCells, cfg.workers)
+		tn, err := graph.NewTransitNodes(g, partition, cfg.workers, logProgress("Computed transit nodes"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Transit node routing uses %d bytes for %d transit nodes, %.1f access nodes per vertex",
+			tn.Bytes(), tn.Len(), tn.AverageAccessNodes())
+		algorithms = append(algorithms, algorithm{"tnr", "Transit node routing (ALT for local queries)", func(src, dest int) ([]int, []int, int) {
+			path, searchSeq := tn.SearchSequence(src, dest, func(v int) graph.PotentialFunc { return potentialFor("alt", v) })
+			return path, searchSeq, -1
+		}})
+	}
+	mapCells = nil
+	if cfg.mapCells > 0 {
+		log.Printf("Partitioning map into %d cells...", cfg.mapCells)
+		mapCells = graph.Partitioners[cfg.partitioner](g, cfg.mapCells, cfg.workers)
+		log.Printf("Partition has %d cells and cuts %d arcs", mapCells.NumCells, len(mapCells.CutArcs(g)))
+	}
+	crpOverlay, crpMetric = nil, nil
+	if cfg.crpLevels > 0 {
+		log.Printf("Building overlay with %d levels of %d cells...", cfg.crpLevels, cfg.crpFanout)
+		crpOverlay = graph.NewOverlay(g, graph.CoordinateMultilevelPartition(g, cfg.crpLevels, cfg.crpFanout))
+		if crpMetric, err = customizeRoutes(g.Weights, cfg.workers); err != nil {
+			log.Fatal(err)
+		}
+		algorithms = append(algorithms, algorithm{"crp", "CRP (Dijkstra on multilevel overlay)", func(src, dest int) ([]int, []int, int) {
+			path, searchSeq := crpMetric.SearchSequence(src, dest)
+			return path, searchSeq, -1
+		}})
+	}
 	searchCache = make(map[string]*ShortestPathInfo)
 }
 
@@ -365,28 +1074,452 @@ func parseCords(s string, xmin, xmax, ymin, ymax, xd, yd float64) graph.Cord {
 	return graph.Cord{Lat: lat, Long: long}
 }
 
+// Maximum number of coordinates accepted in a list parameter
+const maxCordListLen = 1000
+
+// Parses the values of a repeated parameter holding cordinates like
+// "42.2808,-83.7430"
+func parseCordList(values []string) ([]graph.Cord, error) {
+	if len(values) == 0 {
+		return nil, errors.New("at least one cordinate is required")
+	}
+	cords := make([]graph.Cord, 0)
+	for _, part := range values {
+		latLong := strings.Split(part, ",")
+		if len(latLong) != 2 {
+			return nil, fmt.Errorf("invalid cordinate %q", part)
+		}
+		lat, err := strconv.ParseFloat(strings.TrimSpace(latLong[0]), 64)
+		if err != nil || lat < -90 || lat > 90 {
+			return nil, fmt.Errorf("invalid latitude %q", latLong[0])
+		}
+		long, err := strconv.ParseFloat(strings.TrimSpace(latLong[1]), 64)
+		if err != nil || long < -180 || long > 180 {
+			return nil, fmt.Errorf("invalid longitude %q", latLong[1])
+		}
+		cords = append(cords, graph.Cord{Lat: int(lat * 1e6), Long: int(long * 1e6)})
+	}
+	if len(cords) > maxCordListLen {
+		return nil, fmt.Errorf("at most %d cordinates are allowed", maxCordListLen)
+	}
+	return cords, nil
+}
+
+// Most areas and arcs to avoid accepted in a request
+const maxAvoid = 100
+
+// Parses a list of cordinates flattened into "lat,long,lat,long,..."
+func parseFlatCordList(s string) ([]graph.Cord, error) {
+	parts := strings.Split(s, ",")
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("odd number of values in %q", s)
+	}
+	pairs := make([]string, 0, len(parts)/2)
+	for i := 0; i < len(parts); i += 2 {
+		pairs = append(pairs, parts[i]+","+parts[i+1])
+	}
+	return parseCordList(pairs)
+}
+
+// Parses the areas and arcs a route should avoid from the avoid-box
+// (two opposite corners "lat,long,lat,long"), avoid-polygon (three or more
+// corners "lat,long,lat,long,lat,long,...") and avoid-arc ("src,dest" with
+// DIMACS ids) parameters of a parsed form. Returns nil if there are none.
+func parseAvoid(form url.Values) (*graph.Avoid, error) {
+	boxes, polygons, arcs := form["avoid-box"], form["avoid-polygon"], form["avoid-arc"]
+	if len(boxes)+len(polygons)+len(arcs) == 0 {
+		return nil, nil
+	}
+	if len(boxes)+len(polygons)+len(arcs) > maxAvoid {
+		return nil, fmt.Errorf("at most %d areas and arcs can be avoided", maxAvoid)
+	}
+	avoid := &graph.Avoid{}
+	for _, b := range boxes {
+		corners, err := parseFlatCordList(b)
+		if err != nil || len(corners) != 2 {
+			return nil, fmt.Errorf("invalid box %q", b)
+		}
+		avoid.Boxes = append(avoid.Boxes, graph.NewBox(corners[0], corners[1]))
+	}
+	for _, p := range polygons {
+		corners, err := parseFlatCordList(p)
+		if err != nil || len(corners) < 3 {
+			return nil, fmt.Errorf("invalid polygon %q", p)
+		}
+		ring := graph.Ring(append(corners, corners[0]))
+		avoid.Polygons = append(avoid.Polygons, graph.Polygon{ring})
+	}
+	for _, a := range arcs {
+		ends := strings.Split(a, ",")
+		if len(ends) != 2 {
+			return nil, fmt.Errorf("invalid arc %q", a)
+		}
+		src, err1 := strconv.Atoi(strings.TrimSpace(ends[0]))
+		dest, err2 := strconv.Atoi(strings.TrimSpace(ends[1]))
+		if err1 != nil || err2 != nil || roadNetwork.Vertex(src-1) == -1 || roadNetwork.Vertex(dest-1) == -1 {
+			return nil, fmt.Errorf("invalid arc %q", a)
+		}
+		avoid.Arcs = append(avoid.Arcs, [2]int{roadNetwork.Vertex(src - 1), roadNetwork.Vertex(dest - 1)})
+	}
+	return avoid, avoid.Validate(roadNetwork)
+}
+
+// Parses arc costs from the long-arcs ("<weight>,<factor>": arcs heavier
+// than weight cost factor times their weight) and arc-penalty ("<cost>"
+// added to every arc, favouring routes with fewer arcs) parameters.
+// Costs are computed from the weights of network. Returns the costs, or nil
+// if there are neither.
+func parseCost(form url.Values, network *graph.Graph) (*graph.ArcCost, error) {
+	longArcs, arcPenalty := form.Get("long-arcs"), form.Get("arc-penalty")
+	if longArcs == "" && arcPenalty == "" {
+		return nil, nil
+	}
+	limit, factor, penalty := math.MaxInt64, 1.0, 0
+	if longArcs != "" {
+		parts := strings.Split(longArcs, ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid long arcs %q", longArcs)
+		}
+		var err1, err2 error
+		limit, err1 = strconv.Atoi(parts[0])
+		factor, err2 = strconv.ParseFloat(parts[1], 64)
+		if err1 != nil || err2 != nil || limit < 0 || !(factor > 0 && factor <= 100) {
+			return nil, fmt.Errorf("invalid long arcs %q", longArcs)
+		}
+	}
+	if arcPenalty != "" {
+		var err error
+		if penalty, err = strconv.Atoi(arcPenalty); err != nil || abs(penalty) > 1e6 {
+			return nil, fmt.Errorf("invalid arc penalty %q", arcPenalty)
+		}
+	}
+	cost := &graph.ArcCost{
+		Cost: func(u, arc int) int {
+			c := int(network.Weights[arc])
+			if c > limit {
+				c = int(math.Ceil(float64(c) * factor))
+			}
+			return max(c+penalty, 0)
+		},
+		LowerBound: math.Min(factor, 1),
+	}
+	// A negative penalty can make arcs cost less than any fraction of their
+	// weight
+	if penalty < 0 {
+		cost.LowerBound = 0
+	}
+	return cost, nil
+}
+
+// Parses the vehicle, avoid and cost parameters of a parsed form, nil if
+// there are none
+func parseQueryChanges(form url.Values) (*queryChanges, error) {
+	changes := &queryChanges{}
+	if name := form.Get("vehicle"); name != "" {
+		if changes.vehicle = vehicles[name]; changes.vehicle == nil {
+			return nil, fmt.Errorf("vehicle: unknown vehicle %q", name)
+		}
+		changes.key = "vehicle:" + name
+	}
+	avoid, err := parseAvoid(form)
+	if err != nil {
+		return nil, fmt.Errorf("avoid: %v", err)
+	}
+	cost, err := parseCost(form, changes.network())
+	if err != nil {
+		return nil, fmt.Errorf("cost: %v", err)
+	}
+	if turnCost := form.Get("turn-cost"); turnCost != "" {
+		if changes.turnCost, err = strconv.Atoi(turnCost); err != nil || changes.turnCost < 0 || changes.turnCost > 1e6 {
+			return nil, fmt.Errorf("cost: invalid turn cost %q", turnCost)
+		}
+	}
+	if changes.vehicle == nil && avoid == nil && cost == nil && changes.turnCost == 0 {
+		return nil, nil
+	}
+	changes.avoid, changes.cost = avoid, cost
+	if avoid != nil {
+		avoid.Prepare(roadNetwork)
+	}
+	return changes, nil
+}
+
+// Vertex a requested cordinate was snapped to
+type SnappedVertex struct {
+	Lat    int
+	Long   int
+	NodeId int
+}
+
+func snapToVertices(cords []graph.Cord) ([]int, []SnappedVertex) {
+	vertices := make([]int, len(cords))
+	snapped := make([]SnappedVertex, len(cords))
+	for i, cord := range cords {
+		vertices[i] = closestVertex(cord)
+		node := roadNetwork.Nodes[vertices[i]]
+		snapped[i] = SnappedVertex{node.Lat, node.Long, roadNetwork.OriginalID(vertices[i])}
+	}
+	return vertices, snapped
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print(err)
+	}
+}
+
+type Route struct {
+	Distance int
+	// Cost of the route when the request changed arc costs, picked a
+	// vehicle or used turn costs, including the turn costs
+	Cost     int `json:",omitempty"`
+	Vertices []SnappedVertex
+	// Stretches of the route along arcs with the same attributes, when arc
+	// attributes were loaded
+	Segments []Segment `json:",omitempty"`
+}
+
+// Part of a route from Vertices[Start] to Vertices[End] along arcs with the
+// same attributes, like a single road
+type Segment struct {
+	Start      int
+	End        int
+	Distance   int
+	Class      string
+	Name       string `json:",omitempty"`
+	SpeedLimit int    `json:",omitempty"`
+	Toll       bool   `json:",omitempty"`
+	// Stable ID of the arcs, -1 if unknown
+	ID int64
+}
+
+// Splits the path into segments of arcs with the same attributes, nil if
+// the road network has no arc attributes. Steps without an arc, like a
+// pedestrian walking a one-way arc backwards, use the opposite arc.
+func makeSegments(vertices []int) []Segment {
+	attrs := roadNetwork.Attributes
+	if attrs == nil || len(vertices) < 2 {
+		return nil
+	}
+	segments := make([]Segment, 0)
+	var last graph.ArcAttribute
+	for i, arc := range graph.PathArcs(roadNetwork, vertices) {
+		if arc == -1 {
+			arc = graph.PathArcs(roadNetwork, []int{vertices[i+1], vertices[i]})[0]
+		}
+		attr, weight := graph.ArcAttribute{ID: -1}, 0
+		if arc != -1 {
+			attr = attrs.Arc(arc)
+			if w := roadNetwork.Weights[arc]; w != graph.ArcClosed {
+				weight = int(w)
+			}
+		}
+		if len(segments) == 0 || attr != last {
+			segments = append(segments, Segment{
+				Start: i, End: i, Class: attr.Class.String(), Name: attr.Name,
+				SpeedLimit: attr.SpeedLimit, Toll: attr.Toll, ID: attr.ID,
+			})
+			last = attr
+		}
+		segments[len(segments)-1].End = i + 1
+		segments[len(segments)-1].Distance += weight
+	}
+	return segments
+}
+
+type RouteResponse struct {
+	Src  SnappedVertex
+	Dest SnappedVertex
+	// Routes ordered by distance
+	Routes []Route
+	// For routes through via points, the part of the route between each
+	// pair of consecutive stops
+	Legs []Route `json:",omitempty"`
+}
+
+// Most via points allowed in a route
+const maxWaypoints = 25
+
+// Most loopless routes /route finds, since every route after the first
+// takes a search per vertex of the one before while updates wait
+const maxRoutes = 5
+
+// Most alternative routes a request may ask for
+const maxAlternatives = 10
+
+// Route from the reversed path of a ShortestPathInfo
+func makeRouteFromInfo(pathInfo *ShortestPathInfo) Route {
+	route := makeRoute(graph.Reversed(pathInfo.ShortestPath), pathInfo.Distance)
+	route.Cost = pathInfo.Cost
+	return route
+}
+
+func makeRoute(vertices []int, distance int) Route {
+	route := Route{Distance: distance, Vertices: make([]SnappedVertex, len(vertices))}
+	for i, v := range vertices {
+		node := roadNetwork.Nodes[v]
+		route.Vertices[i] = SnappedVertex{node.Lat, node.Long, roadNetwork.OriginalID(v)}
+	}
+	route.Segments = makeSegments(vertices)
+	return route
+}
+
+type TSPResponse struct {
+	// Indices of the requested stops in visiting order
+	Order []int
+	// Depot followed by the stops in visiting order
+	Stops []SnappedVertex
+	// Whole road route and the legs between consecutive stops
+	Route Route
+	Legs  []Route
+}
+
+type ParetoRoute struct {
+	Route
+	SecondCost int
+}
+
+type ParetoResponse struct {
+	Src  SnappedVertex
+	Dest SnappedVertex
+	// Non-dominated routes ordered by increasing distance
+	Routes []ParetoRoute
+}
+
+// Most stops allowed when optimizing stop order
+const maxTSPStops = 100
+
+type DistanceMatrixResponse struct {
+	Sources []SnappedVertex
+	Targets []SnappedVertex
+	// Distances[i][j] is the distance from source i to target j
+	// or null if there is no path
+	Distances [][]*int
+}
+
+// Change to the arcs from Src to Dest, numbered as in the DIMACS files
+type ArcUpdateRequest struct {
+	Src    int
+	Dest   int
+	Weight uint32
+	// Closes the arcs instead of changing their weight
+	Closed bool
+}
+
+// Largest arc update request body accepted
+const maxUpdateBytes = 1 << 20
+
+// Reports whether names is a comma separated list of vehicle profiles
+func validVehicles(names string) bool {
+	for _, name := range strings.Split(names, ",") {
+		if _, ok := graph.VehicleProfiles[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Reads the token arc update requests must present
+func readUpdateToken(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.New("empty update token in " + file)
+	}
+	return token, nil
+}
+
 func main() {
-	if len(os.Args) != 3 && len(os.Args) != 4 {
-		fmt.Fprintf(os.Stderr, "usage: %s <node file> <vertex file> <port>\n", os.Args[0])
+	numLandmarks := flag.Int("landmarks", 16, "number of landmarks to use for ALT")
+	format := flag.String("landmark-format", "uint32", "storage for landmark distances: uint32 (exact) or uint16 (rounded)")
+	order := flag.String("order", "none", "renumber vertices for locality: none, bfs or hilbert")
+	workers := flag.Int("workers", 0, "number of goroutines to use for preprocessing (0 uses all CPUs)")
+	secondCostFile := flag.String("second-costs", "", "arc file with a second cost for every arc, for Pareto routes")
+	attributeFile := flag.String("arc-attributes", "", "file of arc attributes (road class, name, speed limit, toll, id) to return with route segments, which can be an arc file extended with them")
+	profileFile := flag.String("profiles", "", "file of travel time profiles for time dependent routing")
+	turnFile := flag.String("turns", "", "file of banned turns and turn costs for the turns algorithm")
+	classFile := flag.String("road-classes", "", "file of road classes per arc, enabling the vehicle parameter")
+	vehicleNames := flag.String("vehicles", "car,bicycle,foot", "comma separated vehicle profiles to build when road classes are loaded")
+	arcFlagCells := flag.Int("arcflags", 0, "number of cells to compute arc flags for (0 disables arc flags)")
+	reach := flag.Bool("reach", false, "compute reach bounds for the re and real algorithms")
+	reachLimit := flag.Int("reach-limit", 0, "distance from which reaches are left unbounded, trading pruning for preprocessing time (0 picks one from the mean arc weight)")
+	partitioner := flag.String("partitioner", "coordinates", "how to split the map into cells for arc flags, transit nodes and the cells map: coordinates (k-d tree) or inertial (inertial flow); customizable route planning always splits by coordinates")
+	mapCells := flag.Int("map-cells", 0, "number of cells to partition the map into for the cells map mode (0 disables it)")
+	crpLevels := flag.Int("crp-levels", 0, "number of partition levels for customizable route planning (0 disables it)")
+	crpFanout := flag.Int("crp-fanout", 8, "number of cells each cell is split into for customizable route planning")
+	transitCells := flag.Int("transit-cells", 0, "number of cells whose cut vertices become transit nodes for transit node routing (0 disables it)")
+	hubLabelFile := flag.String("hub-labels", "", "file to load hub labels from, or to save them to after computing them if it does not exist")
+	updateTokenFile := flag.String("update-token-file", "", "file holding the bearer token that enables the /update-arcs endpoint (empty disables it)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] <node file> <vertex file> [port]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	landmarkFormat, err := graph.ParseLandmarkFormat(*format)
+	if len(args) != 2 && len(args) != 3 || *numLandmarks < 1 || *arcFlagCells < 0 || *transitCells < 0 || err != nil ||
+		*crpLevels < 0 || *crpFanout < 2 || *mapCells < 0 || graph.Partitioners[*partitioner] == nil ||
+		*order != "none" && graph.VertexOrders[*order] == nil || !validVehicles(*vehicleNames) {
+		flag.Usage()
 		os.Exit(1)
 	}
 	port := 8888
-	if len(os.Args) == 4 {
-		port = parseInt(os.Args[3], 1, (1<<16)-1, 8888)
+	if len(args) == 3 {
+		port = parseInt(args[2], 1, (1<<16)-1, 8888)
+	}
+
+	updateToken := ""
+	if *updateTokenFile != "" {
+		if updateToken, err = readUpdateToken(*updateTokenFile); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	rand.Seed(42)
-	setup(os.Args[1], os.Args[2])
+	setup(config{
+		nodeFile:       args[0],
+		arcFile:        args[1],
+		secondCostFile: *secondCostFile,
+		attributeFile:  *attributeFile,
+		profileFile:    *profileFile,
+		turnFile:       *turnFile,
+		classFile:      *classFile,
+		vehicles:       strings.Split(*vehicleNames, ","),
+		order:          *order,
+		partitioner:    *partitioner,
+		mapCells:       *mapCells,
+		numLandmarks:   *numLandmarks,
+		landmarkFormat: landmarkFormat,
+		arcFlagCells:   *arcFlagCells,
+		reach:          *reach,
+		reachLimit:     *reachLimit,
+		hubLabelFile:   *hubLabelFile,
+		transitCells:   *transitCells,
+		crpLevels:      *crpLevels,
+		crpFanout:      *crpFanout,
+		workers:        *workers,
+	})
 	http.Handle("/", http.FileServer(http.Dir("static")))
-	http.HandleFunc("/map", func(w http.ResponseWriter, r *http.Request) {
+	handleWithNetwork("/algorithms", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, algorithms)
+	})
+	handleWithNetwork("/map", func(w http.ResponseWriter, r *http.Request) {
 		centerx := parseCordPart(r.FormValue("centerx"), -180, 180, -85)
 		centery := parseCordPart(r.FormValue("centery"), -180, 180, 44)
 		radius := parseCordPart(r.FormValue("radius"), 0.01, 90, 5)
 		size := parseInt(r.FormValue("size"), 24, 2000, 400)
+		if r.FormValue("mode") == "cells" && mapCells != nil {
+			drawCells(w, centerx, centery, radius, size)
+			return
+		}
 		drawMap(w, centerx, centery, radius, size)
 	})
 
-	http.HandleFunc("/shortest-path", func(w http.ResponseWriter, r *http.Request) {
+	handleWithNetwork("/shortest-path", func(w http.ResponseWriter, r *http.Request) {
 		maxIdx := len(roadNetwork.Nodes)
 		//src := parseInt(r.FormValue("src"), 1, maxIdx, rand.Intn(maxIdx)+1) - 1
 		//dest := parseInt(r.FormValue("dest"), 1, maxIdx, rand.Intn(maxIdx)+1) - 1
@@ -407,7 +1540,9 @@ func main() {
 		size := parseInt(r.FormValue("size"), 24, 2000, 400)
 		frames := parseInt(r.FormValue("frames"), 1, 120, 15)
 		delay := parseInt(r.FormValue("delay"), 0, 2000, 500) / 10
-		algorithm := parseOption(r.FormValue("algorithm"), []string{"dijkstra", "alt"}, "alt")
+		algorithm := parseOption(r.FormValue("algorithm"), algorithmIDs(), "alt")
+		// Departure time for time dependent routing, -1 for static weights
+		departure := parseInt(r.FormValue("departure"), -1, math.MaxInt32, -1)
 
 		// Panning offset as % of initial display radius
 		xoffset := parseFloat(r.FormValue("xoffset"), -1e6, 1e6, 0)
@@ -415,36 +1550,348 @@ func main() {
 		// Zoom
 		zoom := parseFloat(r.FormValue("zoom"), 0.01, 100, 1)
 
+		// Ordered stops between src and dest
+		r.ParseForm()
+		var waypoints []graph.Cord
+		if len(r.Form["via"]) > 0 {
+			var err error
+			if waypoints, err = parseCordList(r.Form["via"]); err != nil || len(waypoints) > maxWaypoints {
+				http.Error(w, "error: invalid via points", http.StatusBadRequest)
+				return
+			}
+		}
+		changes, err := parseQueryChanges(r.Form)
+		if err != nil {
+			http.Error(w, "error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		alternatives := parseInt(r.FormValue("alternatives"), 0, maxAlternatives, 0)
+		if len(waypoints) > 0 && alternatives > 0 {
+			http.Error(w, "error: via points do not work with alternatives", http.StatusBadRequest)
+			return
+		}
+		if changes != nil && (alternatives > 0 || departure != -1 && profiles != nil || algorithm == "turns") {
+			http.Error(w, "error: vehicle, avoid and cost changes do not work with alternatives, departure or turns", http.StatusBadRequest)
+			return
+		}
+		// Only the edge based search honours the turn table, and legs between
+		// via points are searched apart, so turns at via points would not be
+		if algorithm == "turns" && (alternatives > 0 || departure != -1 && profiles != nil || len(waypoints) > 0) {
+			http.Error(w, "error: turns does not work with alternatives, departure or via points", http.StatusBadRequest)
+			return
+		}
+
 		// Browsers ignore loop count field in gifs :(
-		pathInfo := getShortestPath(src, dest, algorithm)
+		var pathInfo *ShortestPathInfo
+		if len(waypoints) > 0 {
+			stops, _ := snapToVertices(waypoints)
+			stops = append(append([]int{src}, stops...), dest)
+			pathInfo, _ = getMultiStopPath(stops, algorithm, departure, changes)
+		} else {
+			pathInfo = getShortestPath(src, dest, algorithm, alternatives, departure, changes)
+		}
 		drawShortestPath(w, pathInfo, size, frames, delay, xoffset, yoffset, zoom)
 	})
 
-	http.HandleFunc("/vertex", func(w http.ResponseWriter, r *http.Request) {
+	handleWithNetwork("/route", func(w http.ResponseWriter, r *http.Request) {
+		srcCord := parseCords(r.FormValue("src"), -180, 180, -180, 180, -83.74, 42.28)
+		destCord := parseCords(r.FormValue("dest"), -180, 180, -180, 180, -83.53, 41.65)
+		endpoints, snapped := snapToVertices([]graph.Cord{srcCord, destCord})
+		src, dest := endpoints[0], endpoints[1]
+		algorithm := parseOption(r.FormValue("algorithm"), algorithmIDs(), "alt")
+		// Number of loopless routes to return
+		k := parseInt(r.FormValue("k"), 1, maxRoutes, 1)
+
+		// Number of meaningfully different routes to add to the shortest one
+		alternatives := parseInt(r.FormValue("alternatives"), 0, maxAlternatives, 0)
+		// Departure time for time dependent routing, -1 for static weights
+		departure := parseInt(r.FormValue("departure"), -1, math.MaxInt32, -1)
+
+		r.ParseForm()
+		// Routes through via points are a single route
+		if len(r.Form["via"]) > 0 && (alternatives > 0 || k > 1) {
+			http.Error(w, "error: via points do not work with alternatives or k", http.StatusBadRequest)
+			return
+		}
+		changes, err := parseQueryChanges(r.Form)
+		if err != nil {
+			http.Error(w, "error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if changes != nil && (alternatives > 0 || departure != -1 && profiles != nil || algorithm == "turns") {
+			http.Error(w, "error: vehicle, avoid and cost changes do not work with alternatives, departure or turns", http.StatusBadRequest)
+			return
+		}
+		if changes != nil && changes.turnCost > 0 && k > 1 {
+			http.Error(w, "error: turn costs do not work with k", http.StatusBadRequest)
+			return
+		}
+		// Only the edge based search honours the turn table, and legs between
+		// via points are searched apart, so turns at via points would not be
+		if algorithm == "turns" && (alternatives > 0 || k > 1 || departure != -1 && profiles != nil || len(r.Form["via"]) > 0) {
+			http.Error(w, "error: turns does not work with alternatives, k, departure or via points", http.StatusBadRequest)
+			return
+		}
+
+		// Routes through via points have a single route made of legs
+		if len(r.Form["via"]) > 0 {
+			waypoints, err := parseCordList(r.Form["via"])
+			if err != nil || len(waypoints) > maxWaypoints {
+				http.Error(w, "error: invalid via points", http.StatusBadRequest)
+				return
+			}
+			stops, _ := snapToVertices(waypoints)
+			stops = append(append([]int{src}, stops...), dest)
+			route, legs := getMultiStopPath(stops, algorithm, departure, changes)
+			response := RouteResponse{Src: snapped[0], Dest: snapped[1], Routes: []Route{makeRouteFromInfo(route)}}
+			for _, leg := range legs {
+				response.Legs = append(response.Legs, makeRouteFromInfo(leg))
+			}
+			writeJSON(w, response)
+			return
+		}
+
+		if departure != -1 && profiles != nil {
+			route := getShortestPath(src, dest, algorithm, 0, departure, nil)
+			writeJSON(w, RouteResponse{Src: snapped[0], Dest: snapped[1], Routes: []Route{makeRouteFromInfo(route)}})
+			return
+		}
+
+		// Turn restrictions and turn costs need the edge based search, which
+		// finds one route
+		if changes != nil && changes.turnCost > 0 {
+			route := getShortestPath(src, dest, algorithm, 0, -1, changes)
+			writeJSON(w, RouteResponse{Src: snapped[0], Dest: snapped[1], Routes: []Route{makeRouteFromInfo(route)}})
+			return
+		}
+		if algorithm == "turns" {
+			route := getShortestPath(src, dest, algorithm, 0, -1, nil)
+			writeJSON(w, RouteResponse{Src: snapped[0], Dest: snapped[1], Routes: []Route{makeRouteFromInfo(route)}})
+			return
+		}
+
+		var paths []graph.Path
+		switch {
+		case alternatives > 0:
+			opts := graph.DefaultAlternativeOptions
+			opts.Max = alternatives
+			paths = graph.AlternativeRoutes(roadNetwork, reverseNetwork, src, dest, opts)
+		case changes != nil:
+			paths = graph.KShortestPaths(changes.network(), src, dest, k, changes.searchOptions(algorithm, dest))
+		default:
+			paths = graph.KShortestPaths(roadNetwork, src, dest, k, graph.SearchOptions{Potential: potentialFor(algorithm, dest)})
+		}
+		response := RouteResponse{Src: snapped[0], Dest: snapped[1], Routes: make([]Route, 0)}
+		for _, path := range paths {
+			route := makeRoute(path.Vertices, path.Distance)
+			if changes != nil {
+				route.Distance, route.Cost = changes.measure(path.Vertices)
+			}
+			response.Routes = append(response.Routes, route)
+		}
+		writeJSON(w, response)
+	})
+
+	handleWithNetwork("/pareto", func(w http.ResponseWriter, r *http.Request) {
+		if roadNetwork.SecondWeights == nil {
+			http.Error(w, "error: no second arc costs loaded", http.StatusNotImplemented)
+			return
+		}
+		srcCord := parseCords(r.FormValue("src"), -180, 180, -180, 180, -83.74, 42.28)
+		destCord := parseCords(r.FormValue("dest"), -180, 180, -180, 180, -83.53, 41.65)
+		endpoints, snapped := snapToVertices([]graph.Cord{srcCord, destCord})
+		// Labels kept per vertex, bounding the work done for large fronts
+		maxLabels := parseInt(r.FormValue("max-labels"), 1, 1000, 64)
+
+		paths, err := graph.ParetoPaths(roadNetwork, endpoints[0], endpoints[1], maxLabels)
+		if err != nil {
+			http.Error(w, "error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response := ParetoResponse{Src: snapped[0], Dest: snapped[1], Routes: make([]ParetoRoute, 0, len(paths))}
+		for _, path := range paths {
+			response.Routes = append(response.Routes, ParetoRoute{makeRoute(path.Vertices, path.Distance), path.SecondCost})
+		}
+		writeJSON(w, response)
+	})
+
+	handleWithNetwork("/tsp", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		depotCord, err := parseCordList(r.Form["depot"])
+		if err != nil || len(depotCord) != 1 {
+			http.Error(w, "error: exactly one depot is required", http.StatusBadRequest)
+			return
+		}
+		stopCords, err := parseCordList(r.Form["stop"])
+		if err != nil || len(stopCords) > maxTSPStops {
+			http.Error(w, fmt.Sprintf("error: between 1 and %d valid stops are required", maxTSPStops), http.StatusBadRequest)
+			return
+		}
+		returnToDepot := r.FormValue("return") == "true"
+		algorithm := parseOption(r.FormValue("algorithm"), algorithmIDs(), "alt")
+
+		// The depot is stop 0 of the matrix
+		vertices, snapped := snapToVertices(append(depotCord, stopCords...))
+		matrix := distanceMatrix(vertices, vertices)
+		order := graph.SolveTSP(matrix, 0, returnToDepot)
+
+		response := TSPResponse{Order: make([]int, 0, len(stopCords)), Stops: make([]SnappedVertex, 0, len(order))}
+		stops := make([]int, 0, len(order)+1)
+		for _, i := range order {
+			if i != 0 {
+				response.Order = append(response.Order, i-1)
+			}
+			response.Stops = append(response.Stops, snapped[i])
+			stops = append(stops, vertices[i])
+		}
+		if returnToDepot {
+			stops = append(stops, vertices[0])
+		}
+		route, legs := getMultiStopPath(stops, algorithm, -1, nil)
+		response.Route = makeRouteFromInfo(route)
+		for _, leg := range legs {
+			response.Legs = append(response.Legs, makeRouteFromInfo(leg))
+		}
+		writeJSON(w, response)
+	})
+
+	handleWithNetwork("/matrix", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		sourceCords, err := parseCordList(r.Form["source"])
+		if err != nil {
+			http.Error(w, "error: source: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Defaults to distances between every pair of sources
+		targetCords := sourceCords
+		if len(r.Form["target"]) != 0 {
+			if targetCords, err = parseCordList(r.Form["target"]); err != nil {
+				http.Error(w, "error: target: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		sources, snappedSources := snapToVertices(sourceCords)
+		targets, snappedTargets := snapToVertices(targetCords)
+		matrix := distanceMatrix(sources, targets)
+		response := DistanceMatrixResponse{
+			Sources:   snappedSources,
+			Targets:   snappedTargets,
+			Distances: make([][]*int, len(matrix)),
+		}
+		for i, row := range matrix {
+			response.Distances[i] = make([]*int, len(row))
+			for j := range row {
+				if row[j] != math.MaxInt64 {
+					response.Distances[i][j] = &row[j]
+				}
+			}
+		}
+		writeJSON(w, response)
+	})
+
+	handleWithNetwork("/isochrone", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		srcCord := parseCords(r.FormValue("src"), -180, 180, -180, 180, -83.74, 42.28)
+		src := closestVertex(srcCord)
+		budgets := make([]int, 0)
+		for _, b := range r.Form["budget"] {
+			budget, err := strconv.Atoi(b)
+			if err != nil || budget < 0 {
+				http.Error(w, "error: invalid budget", http.StatusBadRequest)
+				return
+			}
+			budgets = append(budgets, budget)
+		}
+		if len(budgets) == 0 || len(budgets) > numBandColors {
+			http.Error(w, fmt.Sprintf("error: between 1 and %d budgets are required", numBandColors), http.StatusBadRequest)
+			return
+		}
+		// Grid resolution in degrees, 0 to pick automatically
+		cellSize := parseCordPart(r.FormValue("cell"), 0, 1, 0)
+		if cellSize != 0 && cellSize < minIsochroneCell {
+			cellSize = minIsochroneCell
+		}
+		iso := getIsochrones(src, budgets, cellSize)
+		if r.FormValue("format") == "geojson" {
+			w.Header().Add("Content-Type", "application/geo+json")
+			json.NewEncoder(w).Encode(iso.geoJSON())
+			return
+		}
+		drawIsochrones(w, iso, parseInt(r.FormValue("size"), 24, 2000, 400))
+	})
+
+	handleWithNetwork("/vertex", func(w http.ResponseWriter, r *http.Request) {
 		i, err := strconv.Atoi(r.FormValue("i"))
 		if err != nil {
 			fmt.Fprintf(w, "error: invalid \"i\" parameter")
 			return
 		}
-		i--
-		if i < 0 || i >= len(roadNetwork.Nodes) {
+		// Vertices are numbered as in the DIMACS files
+		i = roadNetwork.Vertex(i - 1)
+		if i == -1 {
 			fmt.Fprintf(w, "error: index out of range")
 			return
 		}
 		fmt.Fprintf(w, "Cordinates: %s\n", roadNetwork.Nodes[i])
 		fmt.Fprintf(w, "Edges:")
-		for _, dest := range roadNetwork.AdjacencyLists[i] {
-			fmt.Fprintf(w, "\tDestination: %d at %s, Distance: %d\n", dest.Dest+1, roadNetwork.Nodes[dest.Dest], dest.Dist)
+		for _, dest := range roadNetwork.AdjacencyList(i) {
+			fmt.Fprintf(w, "\tDestination: %d at %s, Distance: %d\n", roadNetwork.OriginalID(dest.Dest)+1, roadNetwork.Nodes[dest.Dest], dest.Dist)
 		}
 	})
-	http.HandleFunc("/closest-vertex", func(w http.ResponseWriter, r *http.Request) {
+	handleWithNetwork("/closest-vertex", func(w http.ResponseWriter, r *http.Request) {
 		x := parseCordPart(r.FormValue("x"), -180, 180, -85)
 		y := parseCordPart(r.FormValue("y"), -180, 180, 44)
 		id := closestVertex(graph.Cord{Lat: y, Long: x})
 		lat, long := roadNetwork.Nodes[id].Lat, roadNetwork.Nodes[id].Long
 		w.Header().Add("Content-Type", "application/json")
-		fmt.Fprintf(w, "{\"Lat\": %d, \"Long\": %d, \"NodeId\": %d}", lat, long, id)
+		fmt.Fprintf(w, "{\"Lat\": %d, \"Long\": %d, \"NodeId\": %d}", lat, long, roadNetwork.OriginalID(id))
 	})
+	if updateToken != "" {
+		http.HandleFunc("/update-arcs", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "error: use POST", http.StatusMethodNotAllowed)
+				return
+			}
+			auth := []byte(r.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare(auth, []byte("Bearer "+updateToken)) != 1 {
+				http.Error(w, "error: invalid token", http.StatusUnauthorized)
+				return
+			}
+			var requests []ArcUpdateRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUpdateBytes)).Decode(&requests); err != nil {
+				http.Error(w, "error: invalid updates: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if len(requests) == 0 {
+				http.Error(w, "error: no updates", http.StatusBadRequest)
+				return
+			}
+			updates := make([]graph.ArcUpdate, len(requests))
+			for i, req := range requests {
+				networkLock.RLock()
+				src, dest := roadNetwork.Vertex(req.Src-1), roadNetwork.Vertex(req.Dest-1)
+				networkLock.RUnlock()
+				if src == -1 || dest == -1 {
+					http.Error(w, fmt.Sprintf("error: no arc from %d to %d", req.Src, req.Dest), http.StatusBadRequest)
+					return
+				}
+				if !req.Closed && req.Weight >= graph.ArcClosed {
+					http.Error(w, fmt.Sprintf("error: weight of arc from %d to %d too large, use Closed to close it", req.Src, req.Dest), http.StatusBadRequest)
+					return
+				}
+				updates[i] = graph.ArcUpdate{Src: src, Dest: dest, Weight: req.Weight}
+				if req.Closed {
+					updates[i].Weight = graph.ArcClosed
+				}
+			}
+			response, err := updateArcs(updates, *workers)
+			if err != nil {
+				http.Error(w, "error: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, response)
+		})
+	}
 	log.Print("Starting server...")
 	log.Fatal(http.ListenAndServe(fmt.Sprintf("localhost:%d", port), nil))
 }
@@ -0,0 +1,85 @@
+// Command partition splits a DIMACS road network into cells and writes the
+// cell of every vertex and the arcs between cells.
+//
+// usage: partition [flags] <node file> <arc file> <output prefix>
+//
+// Cells are written to <output prefix>.cells and the cut arcs, in the DIMACS
+// arc file format, to <output prefix>.cut.gr.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/adrs/shortestpath/graph"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Writes one of the outputs to file
+func writeFile(file string, write func(*os.File) error) error {
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := write(out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func main() {
+	methods := make([]string, 0, len(graph.Partitioners))
+	for name := range graph.Partitioners {
+		methods = append(methods, name)
+	}
+	sort.Strings(methods)
+	method := flag.String("method", "inertial", "partitioning method: "+strings.Join(methods, ", "))
+	cellSize := flag.Int("cell-size", 1000, "largest number of vertices in a cell")
+	workers := flag.Int("workers", 0, "number of goroutines to use (0 uses all CPUs)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] <node file> <arc file> <output prefix>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	partitioner := graph.Partitioners[*method]
+	if len(args) != 3 || *cellSize < 1 || partitioner == nil {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	g, err := graph.LoadGraph(args[0], args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	start := time.Now()
+	p := partitioner(g, (len(g.Nodes)+*cellSize-1) / *cellSize, *workers)
+	elapsed := time.Since(start)
+
+	sizes := make([]int, p.NumCells)
+	for _, c := range p.Cell {
+		sizes[c]++
+	}
+	smallest, largest := len(g.Nodes), 0
+	for _, size := range sizes {
+		if size < smallest {
+			smallest = size
+		}
+		if size > largest {
+			largest = size
+		}
+	}
+	fmt.Printf("%d cells of %d to %d vertices, %d arcs cut, %.1f s\n",
+		p.NumCells, smallest, largest, len(p.CutArcs(g)), elapsed.Seconds())
+
+	if err := writeFile(args[2]+".cells", func(out *os.File) error { return p.Write(out, g) }); err != nil {
+		log.Fatal(err)
+	}
+	if err := writeFile(args[2]+".cut.gr", func(out *os.File) error { return p.WriteCutArcs(out, g) }); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -27,9 +27,10 @@ function initMap(id) {
 	var x = parseFloat(params.get('centerx'));
 	var y = parseFloat(params.get('centery'));
 	var radius = parseFloat(params.get('radius'));
+	var mode = '';
 
 	function refresh() {
-		img.src = 'map?centerx=' + x + '&centery=' + y + '&radius=' + radius + '&size=500';
+		img.src = 'map?centerx=' + x + '&centery=' + y + '&radius=' + radius + '&size=500' + mode;
 	}
 
 	function zoom(ratio) {
@@ -51,6 +52,11 @@ function initMap(id) {
 	controls.appendChild(makeButton('Down', function() { pan(0, -0.25); }));
 	controls.appendChild(makeButton('+', function() { zoom(0.75); }))
 	controls.appendChild(makeButton('-', function() { zoom(1/0.75); }))
+	// Colours vertices by partition cell if the server has a partition
+	controls.appendChild(makeButton('Cells', function() {
+		mode = mode === '' ? '&mode=cells' : '';
+		refresh();
+	}));
 	div.appendChild(controls)
 }
 
@@ -97,7 +103,16 @@ function initRouteMap(id) {
 		var dy = $(id + '_dest_lat').value;
 		var dx = -$(id + '_dest_long').value;
 
-		img.src = 'shortest-path?size=' + sizeInput.value +'&frames=' + frameInput.value + '&src=' + sy + ',' + sx + '&dest=' + dy + ',' + dx + '&algorithm=' + algorithmInput.value + '&zoom=' + currentScale + '&xoffset=' + xoffset + '&yoffset=' + yoffset;
+		// Via points are entered as "lat,long; lat,long"
+		var via = '';
+		var points = viaInput.value.split(';');
+		for(var i = 0; i < points.length; i++) {
+			if(points[i].trim() !== '') {
+				via += '&via=' + encodeURIComponent(points[i].trim());
+			}
+		}
+
+		img.src = 'shortest-path?size=' + sizeInput.value +'&frames=' + frameInput.value + '&src=' + sy + ',' + sx + '&dest=' + dy + ',' + dx + via + '&algorithm=' + algorithmInput.value + '&alternatives=' + alternativesInput.value + '&zoom=' + currentScale + '&xoffset=' + xoffset + '&yoffset=' + yoffset;
 
 	}
 
@@ -139,6 +154,13 @@ function initRouteMap(id) {
 	controls = document.createElement('div');
 	controls.appendChild(makeLocationEntry('Source: ', '42.2808', '83.74', id + '_src', search));
 	controls.appendChild(makeLocationEntry('Destination: ', '41.65', '83.53', id + '_dest', search));
+	var viaContainer = document.createElement('div');
+	viaContainer.appendChild(document.createTextNode('Via (lat,long; ...): '));
+	var viaInput = document.createElement('input');
+	viaInput.type = 'text';
+	viaInput.onchange = search;
+	viaContainer.appendChild(viaInput);
+	controls.appendChild(viaContainer);
 	div.appendChild(controls)
 
 	// Frame and animation controls
@@ -169,6 +191,30 @@ function initRouteMap(id) {
 	var algorithmInput = makeDropdown(['Dijkstra', 'ALT (A*, landmarks, triangle inequality)'], ['dijkstra', 'alt']);
 	algorithmInput.onchange = refresh;
 	controls.append(algorithmInput)
+	// Replace the defaults with the algorithms this server has preprocessed
+	fetch('algorithms').then(function(response) { return response.json(); }).then(function(algorithms) {
+		var selected = algorithmInput.value;
+		var labels = [], values = [];
+		for(var i = 0; i < algorithms.length; i++) {
+			labels.push(algorithms[i].Name);
+			values.push(algorithms[i].ID);
+		}
+		var dropdown = makeDropdown(labels, values);
+		dropdown.value = selected;
+		dropdown.onchange = refresh;
+		algorithmInput.replaceWith(dropdown);
+		algorithmInput = dropdown;
+	});
+
+	// Number of alternative routes
+	controls.append(document.createTextNode('Alternatives: '));
+	var alternativesInput = document.createElement('input');
+	alternativesInput.type = 'number';
+	alternativesInput.min = 0;
+	alternativesInput.max = 4;
+	alternativesInput.value = 0;
+	alternativesInput.onchange = refresh;
+	controls.appendChild(alternativesInput);
 	div.appendChild(controls);
 	search();
 }